@@ -1,7 +1,11 @@
 package main
 
-import "github.com/D8-X/d8x-etherfi/internal/svc"
+import (
+	"os"
+
+	"github.com/D8-X/d8x-etherfi/internal/svc"
+)
 
 func main() {
-	svc.Run()
+	svc.Main(os.Args[1:])
 }
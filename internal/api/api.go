@@ -1,42 +1,84 @@
 package api
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"net"
 	"net/http"
+	"time"
 
+	"github.com/D8-X/d8x-etherfi/internal/auth"
 	"github.com/D8-X/d8x-etherfi/internal/etherfi"
+	"github.com/D8-X/d8x-etherfi/internal/metrics"
 	"github.com/go-chi/chi/v5"
 	"golang.org/x/exp/slog"
 )
 
-func StartApiServer(app *etherfi.App, host string, port string) error {
+// StartApiServer serves the API until ctx is canceled. In-flight requests are then
+// completed within the shutdown timeout.
+func StartApiServer(ctx context.Context, app *etherfi.App, authn *auth.Authenticator, host string, port string) error {
+	validator, err := NewValidator(app.Config.ValidateResponses)
+	if err != nil {
+		return err
+	}
+	router := chi.NewRouter()
+	router.Use(metrics.Middleware)
+	registerProbes(router, app)
+	router.Get("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		onOpenApi(w)
+	})
+	router.Group(func(r chi.Router) {
+		if authn != nil {
+			r.Use(authn.Middleware)
+		}
+		r.Use(validator.Middleware)
+		RegisterRoutes(r, app)
+	})
+	return serve(ctx, app, router, host, port)
+}
+
+// StartProbeServer serves only the metrics and the health and readiness
+// probes until ctx is canceled. Used by the indexer.
+func StartProbeServer(ctx context.Context, app *etherfi.App, host string, port string) error {
 	router := chi.NewRouter()
-	RegisterRoutes(router, app)
+	router.Use(metrics.Middleware)
+	registerProbes(router, app)
+	return serve(ctx, app, router, host, port)
+}
 
+// registerProbes registers the metrics and probes, which are not subject to API keys
+func registerProbes(router chi.Router, app *etherfi.App) {
+	router.Method(http.MethodGet, "/metrics", metrics.Handler())
+	router.Get("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		onHealthz(w, app)
+	})
+	router.Get("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		onReadyz(w, app)
+	})
+}
+
+func serve(ctx context.Context, app *etherfi.App, router http.Handler, host string, port string) error {
 	addr := net.JoinHostPort(
 		host,
 		port,
 	)
 	slog.Info("starting api server host_port " + addr)
-	err := http.ListenAndServe(
-		addr,
-		router,
-	)
-	return errors.New("api server is shutting down" + err.Error())
-}
-
-func formatError(errorMsg string) []byte {
-	response := struct {
-		Error string `json:"error"`
-	}{
-		Error: errorMsg,
+	srv := &http.Server{Addr: addr, Handler: router}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errChan:
+		return errors.New("api server stopped:" + err.Error())
+	case <-ctx.Done():
 	}
-	// Marshal the struct into JSON
-	jsonResponse, err := json.Marshal(response)
-	if err != nil {
-		return []byte(err.Error())
+	slog.Info("shutting down api server")
+	timeout := time.Duration(app.Config.ShutdownTimeoutSec) * time.Second
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return errors.New("api server shutdown:" + err.Error())
 	}
-	return jsonResponse
+	return nil
 }
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/D8-X/d8x-etherfi/internal/etherfi"
+	"github.com/D8-X/d8x-etherfi/internal/jobs"
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+)
+
+// toAPIError maps errors to the API error model. Errors that are not
+// known are reported as internal errors without exposing the cause.
+func toAPIError(err error, app *etherfi.App) *utils.APIError {
+	var apiErr *utils.APIError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.Is(err, utils.ErrOverloaded):
+		return &utils.APIError{
+			Status:  http.StatusTooManyRequests,
+			Code:    utils.CODE_OVERLOADED,
+			Message: err.Error(),
+			Details: map[string]interface{}{"retryAfterSeconds": app.Config.RetryAfterSec},
+		}
+	case errors.Is(err, jobs.ErrQueueFull):
+		return &utils.APIError{Status: http.StatusServiceUnavailable, Code: utils.CODE_QUEUE_FULL, Message: err.Error()}
+	case errors.Is(err, jobs.ErrJobNotFound),
+		errors.Is(err, etherfi.ErrSnapshotNotFound),
+		errors.Is(err, etherfi.ErrAddressNotInSnapshot):
+		return utils.NewNotFoundError(err)
+	}
+	return &utils.APIError{Status: http.StatusInternalServerError, Code: utils.CODE_INTERNAL, Message: "request failed", Err: err}
+}
+
+// writeError responds with the status, code and details of the error
+func writeError(w http.ResponseWriter, err error, app *etherfi.App) {
+	apiErr := toAPIError(err, app)
+	if apiErr.Status >= http.StatusInternalServerError {
+		slog.Error(apiErr.Code + ":" + err.Error())
+	} else {
+		slog.Info("rejecting request: " + err.Error())
+	}
+	if apiErr.Code == utils.CODE_OVERLOADED || apiErr.Code == utils.CODE_RPC_UNAVAILABLE {
+		w.Header().Set("Retry-After", strconv.Itoa(app.Config.RetryAfterSec))
+	}
+	writeAPIError(w, apiErr)
+}
+
+// writeAPIError writes the error response
+func writeAPIError(w http.ResponseWriter, apiErr *utils.APIError) {
+	jsonResponse, err := json.Marshal(apiErr)
+	if err != nil {
+		jsonResponse = []byte(`{"code":"INTERNAL","error":"request failed"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.Status)
+	w.Write(jsonResponse)
+}
+
+// writeFieldErrors responds with status 400 and the invalid fields
+func writeFieldErrors(w http.ResponseWriter, fields []utils.FieldError) {
+	writeAPIError(w, utils.NewInvalidInputError(fields...))
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/D8-X/d8x-etherfi/internal/etherfi"
+	"github.com/D8-X/d8x-etherfi/internal/jobs"
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+)
+
+func TestWriteError(t *testing.T) {
+	app := &etherfi.App{}
+	app.Config.RetryAfterSec = 3
+	tests := []struct {
+		err        error
+		status     int
+		code       string
+		retryAfter string
+	}{
+		{utils.NewBlockNotIndexedError(12, 10), http.StatusUnprocessableEntity, utils.CODE_BLOCK_NOT_INDEXED, ""},
+		{fmt.Errorf("balances: %w", utils.NewRpcUnavailableError(errors.New("timeout"))), http.StatusServiceUnavailable, utils.CODE_RPC_UNAVAILABLE, "3"},
+		{utils.NewUpstreamAprError(errors.New("status 500")), http.StatusBadGateway, utils.CODE_UPSTREAM_APR, ""},
+		{utils.ErrOverloaded, http.StatusTooManyRequests, utils.CODE_OVERLOADED, "3"},
+		{jobs.ErrQueueFull, http.StatusServiceUnavailable, utils.CODE_QUEUE_FULL, ""},
+		{etherfi.ErrSnapshotNotFound, http.StatusNotFound, utils.CODE_NOT_FOUND, ""},
+		{errors.New("pq: connection refused"), http.StatusInternalServerError, utils.CODE_INTERNAL, ""},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		writeError(w, tc.err, app)
+		if w.Code != tc.status {
+			t.Errorf("%v: expected status %d, got %d", tc.err, tc.status, w.Code)
+		}
+		if w.Header().Get("Retry-After") != tc.retryAfter {
+			t.Errorf("%v: unexpected Retry-After %q", tc.err, w.Header().Get("Retry-After"))
+		}
+		var res utils.APIError
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Code != tc.code {
+			t.Errorf("%v: expected code %s, got %s", tc.err, tc.code, res.Code)
+		}
+		if tc.code == utils.CODE_INTERNAL && res.Message != "request failed" {
+			t.Errorf("internal error exposed: %s", res.Message)
+		}
+	}
+	w := httptest.NewRecorder()
+	writeError(w, utils.NewBlockNotIndexedError(12, 10), app)
+	var res utils.APIError
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if res.Details["latestBlock"] != float64(10) {
+		t.Errorf("expected latestBlock in details, got %v", res.Details)
+	}
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/D8-X/d8x-etherfi/internal/etherfi"
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+)
+
+type responseFormat int
+
+const (
+	FORMAT_JSON responseFormat = iota
+	FORMAT_CSV
+	FORMAT_NDJSON
+)
+
+// flush the response writer every FLUSH_ROWS streamed rows
+const FLUSH_ROWS = 500
+
+// negotiateFormat determines the response format from the 'format' query
+// parameter or, if not provided, from the Accept header
+func negotiateFormat(r *http.Request) (responseFormat, error) {
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case "json":
+		return FORMAT_JSON, nil
+	case "csv":
+		return FORMAT_CSV, nil
+	case "ndjson", "jsonl":
+		return FORMAT_NDJSON, nil
+	case "":
+	default:
+		return FORMAT_JSON, fmt.Errorf("unsupported format %s, use json, csv or ndjson", r.URL.Query().Get("format"))
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			return FORMAT_JSON, nil
+		case "text/csv":
+			return FORMAT_CSV, nil
+		case "application/x-ndjson", "application/jsonl":
+			return FORMAT_NDJSON, nil
+		}
+	}
+	return FORMAT_JSON, nil
+}
+
+// balanceWriter writes balances row by row in CSV or NDJSON format
+type balanceWriter struct {
+	w       http.ResponseWriter
+	format  responseFormat
+	csv     *csv.Writer
+	enc     *json.Encoder
+	rows    int
+	started bool
+}
+
+func newBalanceWriter(w http.ResponseWriter, format responseFormat) *balanceWriter {
+	bw := balanceWriter{w: w, format: format}
+	if format == FORMAT_CSV {
+		bw.csv = csv.NewWriter(w)
+	} else {
+		bw.enc = json.NewEncoder(w)
+	}
+	return &bw
+}
+
+// start writes the header before the first row
+func (bw *balanceWriter) start() error {
+	bw.started = true
+	if bw.format == FORMAT_CSV {
+		bw.w.Header().Set("Content-Type", "text/csv")
+		bw.w.WriteHeader(http.StatusOK)
+		return bw.csv.Write([]string{"address", "effective_balance", "amount"})
+	}
+	bw.w.Header().Set("Content-Type", "application/x-ndjson")
+	bw.w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (bw *balanceWriter) write(b utils.Balance) error {
+	if !bw.started {
+		if err := bw.start(); err != nil {
+			return err
+		}
+	}
+	var err error
+	if bw.format == FORMAT_CSV {
+		err = bw.csv.Write([]string{b.Address, strconv.FormatFloat(b.EffBalance, 'f', -1, 64), b.Amount.String()})
+	} else {
+		err = bw.enc.Encode(struct {
+			utils.Balance
+			Amount string `json:"amount"`
+		}{b, b.Amount.String()})
+	}
+	if err != nil {
+		return err
+	}
+	bw.rows++
+	if bw.rows%FLUSH_ROWS == 0 {
+		bw.flush()
+	}
+	return nil
+}
+
+func (bw *balanceWriter) flush() {
+	if bw.csv != nil {
+		bw.csv.Flush()
+	}
+	if f, ok := bw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// streamBalanceResponse streams the balances in CSV or NDJSON format without
+// collecting the entire response in memory
+func streamBalanceResponse(req utils.APIBalancesPayload, format responseFormat, w http.ResponseWriter, app *etherfi.App) {
+	bw := newBalanceWriter(w, format)
+	err := app.StreamBalances(req, bw.write)
+	if err != nil {
+		if !bw.started {
+			writeError(w, err, app)
+			return
+		}
+		// headers are sent already, the client sees a truncated body
+		slog.Error("Streaming balances aborted:" + err.Error())
+		return
+	}
+	if !bw.started {
+		// no rows, still send the header
+		if err := bw.start(); err != nil {
+			slog.Error("Streaming balances failed:" + err.Error())
+			return
+		}
+	}
+	bw.flush()
+	msg := fmt.Sprintf("Streamed %d balances for %d addresses on block %d", bw.rows, len(req.Addresses), req.BlockNumber)
+	slog.Info(msg)
+}
+
+// writeBalanceRows writes an already calculated balance response in CSV or
+// NDJSON format. The cursor of the next page is sent in the header 'X-Next-Cursor'.
+func writeBalanceRows(res utils.APIBalancesResponse, format responseFormat, w http.ResponseWriter) {
+	if res.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", res.NextCursor)
+	}
+	bw := newBalanceWriter(w, format)
+	if err := bw.start(); err != nil {
+		slog.Error("Writing balances failed:" + err.Error())
+		return
+	}
+	for _, b := range res.Result {
+		if err := bw.write(b); err != nil {
+			slog.Error("Writing balances failed:" + err.Error())
+			return
+		}
+	}
+	bw.flush()
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"math/big"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	cases := []struct {
+		url    string
+		accept string
+		format responseFormat
+	}{
+		{"/get-balances", "", FORMAT_JSON},
+		{"/get-balances?format=csv", "", FORMAT_CSV},
+		{"/get-balances?format=ndjson", "text/csv", FORMAT_NDJSON},
+		{"/get-balances", "text/csv;charset=utf-8", FORMAT_CSV},
+		{"/get-balances", "text/html, application/x-ndjson", FORMAT_NDJSON},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.url, nil)
+		r.Header.Set("Accept", c.accept)
+		f, err := negotiateFormat(r)
+		if err != nil || f != c.format {
+			t.Errorf("%s %s: got %d %v, expected %d", c.url, c.accept, f, err, c.format)
+		}
+	}
+	r := httptest.NewRequest("GET", "/get-balances?format=xml", nil)
+	if _, err := negotiateFormat(r); err == nil {
+		t.Error("expected error for unsupported format")
+	}
+}
+
+func TestBalanceWriterCSV(t *testing.T) {
+	rec := httptest.NewRecorder()
+	bw := newBalanceWriter(rec, FORMAT_CSV)
+	bw.write(utils.Balance{Address: "0x337a3778244159f37c016196a8e1038a811a34c9", EffBalance: 3635.689148, Amount: big.NewInt(3635689148)})
+	bw.flush()
+	expected := "address,effective_balance,amount\n0x337a3778244159f37c016196a8e1038a811a34c9,3635.689148,3635689148\n"
+	if rec.Body.String() != expected {
+		t.Errorf("unexpected body %q", rec.Body.String())
+	}
+	if rec.Header().Get("Content-Type") != "text/csv" {
+		t.Errorf("unexpected content type %s", rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestBalanceWriterNDJSON(t *testing.T) {
+	rec := httptest.NewRecorder()
+	bw := newBalanceWriter(rec, FORMAT_NDJSON)
+	bw.write(utils.Balance{Address: "0x337a3778244159f37c016196a8e1038a811a34c9", EffBalance: 1.5, Amount: big.NewInt(1500000)})
+	bw.write(utils.Balance{Address: "0x7fcdc35463e3770c2fb992716cd070b63540b947", EffBalance: 0, Amount: big.NewInt(0)})
+	bw.flush()
+	expected := `{"address":"0x337a3778244159f37c016196a8e1038a811a34c9","effective_balance":1.5,"amount":"1500000"}` + "\n" +
+		`{"address":"0x7fcdc35463e3770c2fb992716cd070b63540b947","effective_balance":0,"amount":"0"}` + "\n"
+	if rec.Body.String() != expected {
+		t.Errorf("unexpected body %q", rec.Body.String())
+	}
+}
@@ -1,7 +1,9 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -23,8 +25,7 @@ func onHolderContracts(w http.ResponseWriter, r *http.Request, app *etherfi.App)
 		b, err := strconv.Atoi(blockReq)
 		if err != nil {
 			slog.Error("error in onHolderContracts")
-			errMsg := "invalid block number"
-			http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+			writeFieldErrors(w, []utils.FieldError{{Field: "blockNumber", Message: "invalid block number"}})
 			return
 		}
 		block = big.NewInt(int64(b))
@@ -66,9 +67,7 @@ func onHolderContracts(w http.ResponseWriter, r *http.Request, app *etherfi.App)
 	w.Header().Set("Content-Type", "application/json")
 	jsonResponse, err := json.Marshal(res)
 	if err != nil {
-		slog.Error("error in onHolderContracts")
-		errMsg := "Unavailable"
-		http.Error(w, string(formatError(errMsg)), http.StatusInternalServerError)
+		writeError(w, err, app)
 		return
 	} else {
 		slog.Info("onHolderContracts request answered")
@@ -77,57 +76,16 @@ func onHolderContracts(w http.ResponseWriter, r *http.Request, app *etherfi.App)
 }
 
 func onEtherfiApy(w http.ResponseWriter, r *http.Request, app *etherfi.App) {
-	// Response represents the structure of the JSON response
-	type Response struct {
-		Success    bool     `json:"sucess"`
-		LatestAPRs []string `json:"latest_aprs"`
-	}
 	now := time.Now().Unix()
 	if now-app.EtherfiAPYTs > 43200 {
-		app.EtherfiAPYTs = now
-		// renew query
-		// URL of the endpoint
-		url := "https://www.etherfi.bid/api/etherfi/apr"
-
-		// Sending the GET request
-		resp, err := http.Get(url)
-		if err != nil {
-			slog.Error(fmt.Sprintf("Failed to send GET request: %v", err))
-			http.Error(w, string(formatError("etherfi endpoint unavailable")), http.StatusInternalServerError)
-			return
-		}
-		defer resp.Body.Close()
-
-		// Check if the response status code is OK
-		if resp.StatusCode != http.StatusOK {
-			slog.Error(fmt.Sprintf("Unexpected status code: %d", resp.StatusCode))
-			http.Error(w, string(formatError("etherfi endpoint unavailable")), http.StatusInternalServerError)
-			return
-		}
-
-		// Decoding the JSON response
-		var response Response
-		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-			slog.Error(fmt.Sprintf("Failed to decode JSON response: %v", err))
-			http.Error(w, string(formatError("etherfi endpoint unavailable")), http.StatusInternalServerError)
-			return
-		}
-
-		// Extract the last APR value
-		lastAPRStr := response.LatestAPRs[len(response.LatestAPRs)-1]
-		lastAPR, err := strconv.ParseFloat(lastAPRStr, 64)
+		apy, err := queryEtherfiApy()
 		if err != nil {
-			slog.Error(fmt.Sprintf("Failed to convert APR to float: %v", err))
-			http.Error(w, string(formatError("etherfi endpoint returns unexpected result")), http.StatusInternalServerError)
+			writeError(w, utils.NewUpstreamAprError(err), app)
 			return
 		}
-
-		// Adjust the APR by the given factor
-		adjustedAPR := lastAPR / 0.9 / (29.0 / 32.0) / 100.0
-
-		// Round to 2 decimal places
-		roundedAPR := math.Round(adjustedAPR*100) / 100
-		app.EtherfiAPY = roundedAPR
+		// only cache successful queries, so that failures are retried
+		app.EtherfiAPY = apy
+		app.EtherfiAPYTs = now
 	}
 	w.Header().Set("Content-Type", "application/json")
 	type Response2 struct {
@@ -138,33 +96,130 @@ func onEtherfiApy(w http.ResponseWriter, r *http.Request, app *etherfi.App) {
 	w.Write(jsonResponse)
 }
 
+// queryEtherfiApy gets the latest APR from etherfi and converts it into the APY
+func queryEtherfiApy() (float64, error) {
+	// Response represents the structure of the JSON response
+	type Response struct {
+		Success    bool     `json:"sucess"`
+		LatestAPRs []string `json:"latest_aprs"`
+	}
+	// URL of the endpoint
+	url := "https://www.etherfi.bid/api/etherfi/apr"
+
+	// Sending the GET request
+	resp, err := http.Get(url)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send GET request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Check if the response status code is OK
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	// Decoding the JSON response
+	var response Response
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return 0, fmt.Errorf("failed to decode JSON response: %v", err)
+	}
+	if len(response.LatestAPRs) == 0 {
+		return 0, errors.New("no APR in response")
+	}
+
+	// Extract the last APR value
+	lastAPRStr := response.LatestAPRs[len(response.LatestAPRs)-1]
+	lastAPR, err := strconv.ParseFloat(lastAPRStr, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to convert APR to float: %v", err)
+	}
+
+	// Adjust the APR by the given factor
+	adjustedAPR := lastAPR / 0.9 / (29.0 / 32.0) / 100.0
+
+	// Round to 2 decimal places
+	return math.Round(adjustedAPR*100) / 100, nil
+}
+
 func onGetBalances(w http.ResponseWriter, r *http.Request, app *etherfi.App) {
 	blockReq := r.URL.Query().Get("blockNumber")
 	addrs := r.URL.Query()["addresses"]
+	cursor := r.URL.Query().Get("cursor")
 	block := app.DBGetLatestBlock()
-	if blockReq != "" {
-		blockNum, err := strconv.Atoi(blockReq)
+	if blockReq == "" && cursor == "" {
+		// answer from the precomputed balances if available
+		if b := app.LatestBalancesBlock(); b > 0 {
+			block = b
+		}
+	}
+	if blockReq == "" && cursor != "" {
+		// continue paging through the block of the first page
+		cursorBlock, err := utils.CursorBlock(cursor)
 		if err != nil {
-			block = min(block, uint64(blockNum))
+			writeFieldErrors(w, []utils.FieldError{{Field: "cursor", Message: err.Error()}})
+			return
 		}
+		blockReq = strconv.FormatUint(cursorBlock, 10)
 	}
-	// check input
-	for k, addr := range addrs {
-		if !utils.IsValidEvmAddr(addr) {
-			http.Error(w, string(formatError("malformated address in request")), http.StatusBadRequest)
-			slog.Info("malformated address in get request")
+	if blockReq != "" {
+		blockNum, err := strconv.Atoi(blockReq)
+		if err != nil {
+			writeFieldErrors(w, []utils.FieldError{{Field: "blockNumber", Message: "invalid block number"}})
 			return
 		}
-		addrs[k] = strings.ToLower(addrs[k])
+		block = min(block, uint64(blockNum))
 	}
 	req := utils.APIBalancesPayload{
 		BlockNumber: block,
 		Addresses:   addrs,
+		Sort:        r.URL.Query().Get("sort"),
+		Cursor:      cursor,
+	}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil {
+			writeFieldErrors(w, []utils.FieldError{{Field: "limit", Message: "invalid limit"}})
+			return
+		}
+		req.Limit = l
+	}
+	if minBal := r.URL.Query().Get("minBalance"); minBal != "" {
+		m, err := strconv.ParseFloat(minBal, 64)
+		if err != nil {
+			writeFieldErrors(w, []utils.FieldError{{Field: "minBalance", Message: "invalid minBalance"}})
+			return
+		}
+		req.MinBalance = m
 	}
-	balanceResponse(req, w, app)
+	if fields := validateBalancesPayload(&req); len(fields) > 0 {
+		slog.Info("invalid get-balances request")
+		writeFieldErrors(w, fields)
+		return
+	}
+	format, err := negotiateFormat(r)
+	if err != nil {
+		writeFieldErrors(w, []utils.FieldError{{Field: "format", Message: err.Error()}})
+		return
+	}
+	balanceResponse(r.Context(), req, format, w, app)
 }
 
 func onBalances(w http.ResponseWriter, r *http.Request, app *etherfi.App) {
+	format, err := negotiateFormat(r)
+	if err != nil {
+		writeFieldErrors(w, []utils.FieldError{{Field: "format", Message: err.Error()}})
+		return
+	}
+	req, ok := readBalancesPayload(w, r, app)
+	if !ok {
+		return
+	}
+	balanceResponse(r.Context(), req, format, w, app)
+}
+
+// readBalancesPayload reads and validates the balances payload of POST
+// requests. On invalid input the error is written and false returned.
+func readBalancesPayload(w http.ResponseWriter, r *http.Request, app *etherfi.App) (utils.APIBalancesPayload, bool) {
 	// Read the JSON data from the request body
 	var jsonData []byte
 	if r.Body != nil {
@@ -174,50 +229,65 @@ func onBalances(w http.ResponseWriter, r *http.Request, app *etherfi.App) {
 	var req utils.APIBalancesPayload
 	err := json.Unmarshal(jsonData, &req)
 	if err != nil {
-		errMsg := `Wrong argument types. Usage:
-		{
-		   'blockNumber': 195374242,
-		   'addresses': ['0xaCFe...']
-	    }`
-		errMsg = strings.ReplaceAll(errMsg, "\t", "")
-		errMsg = strings.ReplaceAll(errMsg, "\n", "")
-		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
 		slog.Info("onBalances invalid request:" + err.Error())
-		return
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			writeFieldErrors(w, []utils.FieldError{{Field: typeErr.Field, Message: "must be of type " + typeErr.Type.String()}})
+			return req, false
+		}
+		writeFieldErrors(w, []utils.FieldError{{Field: "", Message: "invalid JSON: " + err.Error()}})
+		return req, false
 	}
-	// check input
+	if fields := validateBalancesPayload(&req); len(fields) > 0 {
+		slog.Info("invalid balances request")
+		writeFieldErrors(w, fields)
+		return req, false
+	}
+	lb := app.DBGetLatestBlock()
+	if uint64(req.BlockNumber) > lb {
+		writeError(w, utils.NewBlockNotIndexedError(req.BlockNumber, lb), app)
+		return req, false
+	}
+	return req, true
+}
+
+// validateBalancesPayload checks the addresses and paging parameters and
+// converts the addresses to lower case
+func validateBalancesPayload(req *utils.APIBalancesPayload) []utils.FieldError {
+	var fields []utils.FieldError
 	for k, addr := range req.Addresses {
 		if !utils.IsValidEvmAddr(addr) {
-			http.Error(w, string(formatError("malformated address in request")), http.StatusBadRequest)
-			slog.Info("malformated address in request")
-			return
+			fields = append(fields, utils.FieldError{Field: fmt.Sprintf("addresses.%d", k), Message: "malformed address"})
+			continue
 		}
-		req.Addresses[k] = strings.ToLower(req.Addresses[k])
+		req.Addresses[k] = strings.ToLower(addr)
 	}
-	lb := app.DBGetLatestBlock()
-	if uint64(req.BlockNumber) > lb {
-		msg := fmt.Sprintf("queried block %d but only %d available", req.BlockNumber, lb)
-		slog.Error(msg)
-		http.Error(w, string(formatError("requested block not available")), http.StatusInternalServerError)
-		return
+	if err := req.ValidatePage(); err != nil {
+		fields = append(fields, utils.FieldError{Field: "cursor", Message: err.Error()})
 	}
-	balanceResponse(req, w, app)
+	return fields
 }
 
 // balanceResponse is shared between the GET and POST request
-func balanceResponse(req utils.APIBalancesPayload, w http.ResponseWriter, app *etherfi.App) {
-	res, err := app.Balances(req)
+func balanceResponse(ctx context.Context, req utils.APIBalancesPayload, format responseFormat, w http.ResponseWriter, app *etherfi.App) {
+	if format != FORMAT_JSON && !req.IsPaged() {
+		streamBalanceResponse(req, format, w, app)
+		return
+	}
+	res, err := app.BalancesResult(ctx, req)
 	if err != nil {
-		slog.Error("Could not determine balances:" + err.Error())
-		http.Error(w, string(formatError("request failed")), http.StatusInternalServerError)
+		writeError(w, err, app)
+		return
+	}
+	if format != FORMAT_JSON {
+		writeBalanceRows(res, format, w)
 		return
 	}
 	// Set the Content-Type header to application/json
 	w.Header().Set("Content-Type", "application/json")
 	jsonResponse, err := json.Marshal(res)
 	if err != nil {
-		slog.Error("Failed parsing balance response:" + err.Error())
-		http.Error(w, string(formatError("request failed")), http.StatusInternalServerError)
+		writeError(w, err, app)
 		return
 	}
 	msg := fmt.Sprintf("Responding to balance request for %d addresses on block %d", len(req.Addresses), req.BlockNumber)
@@ -225,3 +295,160 @@ func balanceResponse(req utils.APIBalancesPayload, w http.ResponseWriter, app *e
 	// Write the JSON response
 	w.Write(jsonResponse)
 }
+
+// onCacheStats returns the hit and miss counts of the balance cache
+func onCacheStats(w http.ResponseWriter, app *etherfi.App) {
+	w.Header().Set("Content-Type", "application/json")
+	jsonResponse, _ := json.Marshal(app.CacheStats())
+	w.Write(jsonResponse)
+}
+
+// onCreateSnapshot stores the balances of all holders at the requested block
+// together with the Merkle root
+func onCreateSnapshot(w http.ResponseWriter, r *http.Request, app *etherfi.App) {
+	var jsonData []byte
+	if r.Body != nil {
+		defer r.Body.Close()
+		jsonData, _ = io.ReadAll(r.Body)
+	}
+	var req utils.APISnapshotPayload
+	err := json.Unmarshal(jsonData, &req)
+	if err != nil {
+		slog.Info("onCreateSnapshot invalid request:" + err.Error())
+		writeFieldErrors(w, []utils.FieldError{{Field: "blockNumber", Message: "must be a block number"}})
+		return
+	}
+	if req.BlockNumber == 0 {
+		writeFieldErrors(w, []utils.FieldError{{Field: "blockNumber", Message: "must be a block number"}})
+		return
+	}
+	lb := app.DBGetLatestBlock()
+	if req.BlockNumber > lb {
+		writeError(w, utils.NewBlockNotIndexedError(req.BlockNumber, lb), app)
+		return
+	}
+	res, err := app.CreateSnapshot(req.BlockNumber)
+	if err != nil {
+		writeError(w, err, app)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonResponse, _ := json.Marshal(res)
+	w.Write(jsonResponse)
+}
+
+// onSnapshot returns the Merkle root of a stored snapshot
+func onSnapshot(w http.ResponseWriter, r *http.Request, app *etherfi.App) {
+	block, err := strconv.ParseUint(r.URL.Query().Get("snapshot"), 10, 64)
+	if err != nil {
+		writeFieldErrors(w, []utils.FieldError{{Field: "snapshot", Message: "invalid snapshot block number"}})
+		return
+	}
+	res, err := app.Snapshot(block)
+	if err != nil {
+		writeError(w, err, app)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonResponse, _ := json.Marshal(res)
+	w.Write(jsonResponse)
+}
+
+// onProof returns the Merkle proof for an address in a stored snapshot
+func onProof(w http.ResponseWriter, r *http.Request, app *etherfi.App) {
+	addr := r.URL.Query().Get("address")
+	if !utils.IsValidEvmAddr(addr) {
+		writeFieldErrors(w, []utils.FieldError{{Field: "address", Message: "malformed address"}})
+		return
+	}
+	block, err := strconv.ParseUint(r.URL.Query().Get("snapshot"), 10, 64)
+	if err != nil {
+		writeFieldErrors(w, []utils.FieldError{{Field: "snapshot", Message: "invalid snapshot block number"}})
+		return
+	}
+	res, err := app.SnapshotProof(block, addr)
+	if err != nil {
+		writeError(w, err, app)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonResponse, _ := json.Marshal(res)
+	w.Write(jsonResponse)
+}
+
+// onHistory returns the perpetual trades, margin changes, liquidations and
+// settlements of a trader
+func onHistory(w http.ResponseWriter, r *http.Request, app *etherfi.App) {
+	q := r.URL.Query()
+	addr := q.Get("address")
+	if !utils.IsValidEvmAddr(addr) {
+		writeFieldErrors(w, []utils.FieldError{{Field: "address", Message: "malformed address"}})
+		return
+	}
+	var blocks [2]uint64
+	for k, field := range []string{"fromBlock", "toBlock"} {
+		if v := q.Get(field); v != "" {
+			block, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				writeFieldErrors(w, []utils.FieldError{{Field: field, Message: "invalid block number"}})
+				return
+			}
+			blocks[k] = block
+		}
+	}
+	var limit int
+	if v := q.Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 0 {
+			writeFieldErrors(w, []utils.FieldError{{Field: "limit", Message: "invalid limit"}})
+			return
+		}
+		limit = l
+	}
+	res, err := app.TraderHistory(addr, blocks[0], blocks[1], limit, q.Get("cursor"))
+	if errors.Is(err, etherfi.ErrInvalidHistoryCursor) {
+		writeFieldErrors(w, []utils.FieldError{{Field: "cursor", Message: err.Error()}})
+		return
+	}
+	if err != nil {
+		writeError(w, err, app)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonResponse, _ := json.Marshal(res)
+	w.Write(jsonResponse)
+}
+
+func onHealthz(w http.ResponseWriter, app *etherfi.App) {
+	if err := app.Health(); err != nil {
+		slog.Error("health check failed:" + err.Error())
+		writeAPIError(w, &utils.APIError{Status: http.StatusServiceUnavailable, Code: utils.CODE_INTERNAL, Message: err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+func onReadyz(w http.ResponseWriter, app *etherfi.App) {
+	status := app.Readiness()
+	jsonResponse, err := json.Marshal(status)
+	if err != nil {
+		writeError(w, err, app)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(jsonResponse)
+}
+
+func onStatus(w http.ResponseWriter, app *etherfi.App) {
+	jsonResponse, err := json.Marshal(app.Status())
+	if err != nil {
+		writeError(w, err, app)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
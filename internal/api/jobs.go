@@ -0,0 +1,40 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/D8-X/d8x-etherfi/internal/etherfi"
+	"github.com/go-chi/chi/v5"
+)
+
+// onCreateBalanceJob queues a balance computation and returns the job id.
+// The payload is the same as for /balances
+func onCreateBalanceJob(w http.ResponseWriter, r *http.Request, app *etherfi.App) {
+	req, ok := readBalancesPayload(w, r, app)
+	if !ok {
+		return
+	}
+	job, err := app.Jobs.Submit(req)
+	if err != nil {
+		writeError(w, err, app)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+job.Id)
+	w.WriteHeader(http.StatusAccepted)
+	jsonResponse, _ := json.Marshal(job)
+	w.Write(jsonResponse)
+}
+
+// onGetJob returns the status and, once completed, the result or error of a job
+func onGetJob(w http.ResponseWriter, r *http.Request, app *etherfi.App) {
+	job, err := app.Jobs.Get(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, err, app)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonResponse, _ := json.Marshal(job)
+	w.Write(jsonResponse)
+}
@@ -26,4 +26,36 @@ func RegisterRoutes(router chi.Router, app *etherfi.App) {
 		onBalances(w, r, app)
 	})
 
+	router.Get("/status", func(w http.ResponseWriter, r *http.Request) {
+		onStatus(w, app)
+	})
+
+	router.Get("/cache-stats", func(w http.ResponseWriter, r *http.Request) {
+		onCacheStats(w, app)
+	})
+
+	router.Post("/jobs/balances", func(w http.ResponseWriter, r *http.Request) {
+		onCreateBalanceJob(w, r, app)
+	})
+
+	router.Get("/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		onGetJob(w, r, app)
+	})
+
+	router.Post("/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		onCreateSnapshot(w, r, app)
+	})
+
+	router.Get("/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		onSnapshot(w, r, app)
+	})
+
+	router.Get("/proof", func(w http.ResponseWriter, r *http.Request) {
+		onProof(w, r, app)
+	})
+
+	router.Get("/history", func(w http.ResponseWriter, r *http.Request) {
+		onHistory(w, r, app)
+	})
+
 }
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+)
+
+// openapiSpec is the API contract, served at /openapi.json and used
+// to validate requests and responses
+//
+//go:embed openapi.json
+var openapiSpec []byte
+
+// Validator validates requests, and optionally responses, against the
+// OpenAPI specification
+type Validator struct {
+	router            routers.Router
+	validateResponses bool
+}
+
+func NewValidator(validateResponses bool) (*Validator, error) {
+	loader := openapi3.NewLoader()
+	spec, err := loader.LoadFromData(openapiSpec)
+	if err != nil {
+		return nil, errors.New("invalid openapi spec:" + err.Error())
+	}
+	if err := spec.Validate(loader.Context); err != nil {
+		return nil, errors.New("invalid openapi spec:" + err.Error())
+	}
+	router, err := gorillamux.NewRouter(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &Validator{router: router, validateResponses: validateResponses}, nil
+}
+
+// Middleware rejects requests that do not match the specification with
+// status 400 and the list of invalid fields. Requests to paths that are not
+// specified are passed on unchanged. Responses that do not match the
+// specification are logged.
+func (v *Validator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, pathParams, err := v.router.FindRoute(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defaultJsonBody(r, route)
+		input := &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+			Options: &openapi3filter.Options{
+				MultiError: true,
+				// API keys are checked by the auth middleware
+				AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+			},
+		}
+		if err := openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+			writeFieldErrors(w, fieldErrors(err))
+			return
+		}
+		if !v.validateResponses {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		resInput := &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: input,
+			Status:                 rec.status,
+			Header:                 rec.Header(),
+			Body:                   io.NopCloser(bytes.NewReader(rec.body.Bytes())),
+			Options:                &openapi3filter.Options{MultiError: true, IncludeResponseStatus: true},
+		}
+		if err := openapi3filter.ValidateResponse(r.Context(), resInput); err != nil {
+			slog.Error("response of " + r.Method + " " + r.URL.Path + " violates the openapi spec:" + err.Error())
+		}
+	})
+}
+
+// defaultJsonBody treats the body of requests to JSON-bodied routes as JSON if the
+// Content-Type is missing or not JSON, as the handlers did before validation
+// (e.g. curl -d sends application/x-www-form-urlencoded)
+func defaultJsonBody(r *http.Request, route *routers.Route) {
+	body := route.Operation.RequestBody
+	if body == nil || body.Value == nil || body.Value.Content.Get("application/json") == nil {
+		return
+	}
+	if strings.Contains(strings.ToLower(r.Header.Get("Content-Type")), "json") {
+		return
+	}
+	r.Header.Set("Content-Type", "application/json")
+}
+
+// onOpenApi serves the OpenAPI specification
+func onOpenApi(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openapiSpec)
+}
+
+// fieldErrors converts the errors of the request validation into field errors
+func fieldErrors(err error) []utils.FieldError {
+	switch e := err.(type) {
+	case openapi3.MultiError:
+		fields := make([]utils.FieldError, 0, len(e))
+		for _, err := range e {
+			fields = append(fields, fieldErrors(err)...)
+		}
+		return fields
+	case *openapi3filter.RequestError:
+		if e.Parameter != nil {
+			fields := []utils.FieldError{{Field: e.Parameter.Name, Message: e.Reason}}
+			if e.Err != nil {
+				fields = fieldErrors(e.Err)
+				for k := range fields {
+					fields[k].Field = strings.TrimSuffix(e.Parameter.Name+"."+fields[k].Field, ".")
+				}
+			}
+			return fields
+		}
+		if e.Err != nil {
+			return fieldErrors(e.Err)
+		}
+		return []utils.FieldError{{Field: "", Message: e.Reason}}
+	case *openapi3.SchemaError:
+		return []utils.FieldError{{Field: strings.Join(e.JSONPointer(), "."), Message: e.Reason}}
+	case *openapi3filter.ParseError:
+		if e.Cause != nil {
+			return []utils.FieldError{{Field: "", Message: e.Reason + ": " + e.Cause.Error()}}
+		}
+		return []utils.FieldError{{Field: "", Message: e.Reason}}
+	}
+	return []utils.FieldError{{Field: "", Message: err.Error()}}
+}
+
+// responseRecorder passes the response on and keeps a copy for validation
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
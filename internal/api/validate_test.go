@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+)
+
+func TestValidatorMiddleware(t *testing.T) {
+	v, err := NewValidator(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"Result":[]}`))
+	}))
+	tests := []struct {
+		name   string
+		req    *http.Request
+		fields []string
+	}{
+		{
+			name: "valid body",
+			req:  httptest.NewRequest(http.MethodPost, "/balances", strings.NewReader(`{"blockNumber":1,"addresses":["0x337a3778244159f37c016196a8e1038a811a34c9"]}`)),
+		},
+		{
+			name:   "wrong types",
+			req:    httptest.NewRequest(http.MethodPost, "/balances", strings.NewReader(`{"blockNumber":"x","addresses":["0x12"],"sort":"size"}`)),
+			fields: []string{"addresses.0", "blockNumber", "sort"},
+		},
+		{
+			name: "missing block",
+			req:  httptest.NewRequest(http.MethodPost, "/balances", strings.NewReader(`{}`)),
+		},
+		{
+			name:   "negative block",
+			req:    httptest.NewRequest(http.MethodPost, "/balances", strings.NewReader(`{"blockNumber":-1}`)),
+			fields: []string{"blockNumber"},
+		},
+		{
+			name:   "query parameters",
+			req:    httptest.NewRequest(http.MethodGet, "/get-balances?limit=-1&addresses=0x12", nil),
+			fields: []string{"addresses.0", "limit"},
+		},
+		{
+			name: "jsonl format",
+			req:  httptest.NewRequest(http.MethodGet, "/get-balances?format=jsonl", nil),
+		},
+		{
+			name:   "unknown format",
+			req:    httptest.NewRequest(http.MethodGet, "/get-balances?format=xml", nil),
+			fields: []string{"format"},
+		},
+		{
+			name: "unspecified path",
+			req:  httptest.NewRequest(http.MethodGet, "/unknown?limit=x", nil),
+		},
+	}
+	// curl -d sends a form content type, clients may send none
+	noType := httptest.NewRequest(http.MethodPost, "/balances", strings.NewReader(`{"blockNumber":1}`))
+	formType := httptest.NewRequest(http.MethodPost, "/balances", strings.NewReader(`{"blockNumber":1}`))
+	formType.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for name, req := range map[string]*http.Request{"no content type": noType, "form content type": formType} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d %s", name, w.Code, w.Body.String())
+		}
+	}
+	for _, tc := range tests {
+		tc.req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, tc.req)
+		if len(tc.fields) == 0 {
+			if w.Code != http.StatusOK {
+				t.Errorf("%s: expected 200, got %d %s", tc.name, w.Code, w.Body.String())
+			}
+			continue
+		}
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", tc.name, w.Code)
+			continue
+		}
+		var res struct {
+			Fields []utils.FieldError `json:"fields"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]bool)
+		for _, f := range res.Fields {
+			got[f.Field] = true
+		}
+		for _, f := range tc.fields {
+			if !got[f] {
+				t.Errorf("%s: expected error for field %s, got %+v", tc.name, f, res.Fields)
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package attest
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"math/big"
+	"strings"
+
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+const (
+	DOMAIN_NAME    = "D8X Etherfi Balances"
+	DOMAIN_VERSION = "1"
+)
+
+// balanceTypes are the EIP-712 types of the attestation. Amounts are the
+// effective balances in decimal-N units of the pool token and can be negative.
+var balanceTypes = apitypes.Types{
+	"EIP712Domain": {
+		{Name: "name", Type: "string"},
+		{Name: "version", Type: "string"},
+		{Name: "chainId", Type: "uint256"},
+	},
+	"Balance": {
+		{Name: "account", Type: "address"},
+		{Name: "amount", Type: "int256"},
+	},
+	"BalanceAttestation": {
+		{Name: "chainId", Type: "uint256"},
+		{Name: "blockNumber", Type: "uint256"},
+		{Name: "poolToken", Type: "address"},
+		{Name: "balances", Type: "Balance[]"},
+	},
+}
+
+// TypedData returns the EIP-712 typed data of the attestation for the given
+// balances. balances and att.Amounts are ordered in the same way.
+func TypedData(att *utils.Attestation, balances []utils.Balance) (apitypes.TypedData, error) {
+	if len(balances) != len(att.Amounts) {
+		return apitypes.TypedData{}, errors.New("number of balances and amounts differ")
+	}
+	list := make([]interface{}, 0, len(balances))
+	for k, b := range balances {
+		if !common.IsHexAddress(b.Address) {
+			return apitypes.TypedData{}, errors.New("invalid address " + b.Address)
+		}
+		amount, ok := new(big.Int).SetString(att.Amounts[k], 10)
+		if !ok {
+			return apitypes.TypedData{}, errors.New("invalid amount " + att.Amounts[k])
+		}
+		list = append(list, map[string]interface{}{
+			"account": b.Address,
+			"amount":  amount,
+		})
+	}
+	chainId := math.NewHexOrDecimal256(att.ChainId)
+	return apitypes.TypedData{
+		Types:       balanceTypes,
+		PrimaryType: "BalanceAttestation",
+		Domain: apitypes.TypedDataDomain{
+			Name:    DOMAIN_NAME,
+			Version: DOMAIN_VERSION,
+			ChainId: chainId,
+		},
+		Message: apitypes.TypedDataMessage{
+			"chainId":     new(big.Int).SetInt64(att.ChainId),
+			"blockNumber": new(big.Int).SetUint64(att.BlockNumber),
+			"poolToken":   att.PoolToken,
+			"balances":    list,
+		},
+	}, nil
+}
+
+// Sign creates the attestation for the balance response and signs it with
+// the given key
+func Sign(key *ecdsa.PrivateKey, chainId int64, blockNumber uint64, poolToken common.Address, balances []utils.Balance) (*utils.Attestation, error) {
+	att := utils.Attestation{
+		ChainId:     chainId,
+		BlockNumber: blockNumber,
+		PoolToken:   strings.ToLower(poolToken.Hex()),
+		Amounts:     make([]string, 0, len(balances)),
+		Signer:      strings.ToLower(crypto.PubkeyToAddress(key.PublicKey).Hex()),
+	}
+	for _, b := range balances {
+		if b.Amount == nil {
+			return nil, errors.New("balance amount missing for " + b.Address)
+		}
+		att.Amounts = append(att.Amounts, b.Amount.String())
+	}
+	hash, err := hashAttestation(&att, balances)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := crypto.Sign(hash, key)
+	if err != nil {
+		return nil, err
+	}
+	// use 27/28 as recovery id like eth_signTypedData
+	sig[crypto.RecoveryIDOffset] += 27
+	att.Signature = hexutil.Encode(sig)
+	return &att, nil
+}
+
+// Verify checks that the attestation in the response was signed by
+// the expected signer
+func Verify(res *utils.APIBalancesResponse, signer common.Address) error {
+	att := res.Attestation
+	if att == nil {
+		return errors.New("response has no attestation")
+	}
+	hash, err := hashAttestation(att, res.Result)
+	if err != nil {
+		return err
+	}
+	sig, err := hexutil.Decode(att.Signature)
+	if err != nil {
+		return err
+	}
+	if len(sig) != crypto.SignatureLength {
+		return errors.New("invalid signature length")
+	}
+	sig = common.CopyBytes(sig)
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+	pub, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		return err
+	}
+	if crypto.PubkeyToAddress(*pub) != signer {
+		return errors.New("attestation not signed by " + signer.Hex())
+	}
+	return nil
+}
+
+func hashAttestation(att *utils.Attestation, balances []utils.Balance) ([]byte, error) {
+	td, err := TypedData(att, balances)
+	if err != nil {
+		return nil, err
+	}
+	hash, _, err := apitypes.TypedDataAndHash(td)
+	return hash, err
+}
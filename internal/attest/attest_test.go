@@ -0,0 +1,46 @@
+package attest
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestSignVerify(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := utils.APIBalancesResponse{
+		Result: []utils.Balance{
+			{Address: "0x337a3778244159f37c016196a8e1038a811a34c9", EffBalance: 3635.689148, Amount: big.NewInt(3635689148)},
+			{Address: "0x7fcdc35463e3770c2fb992716cd070b63540b947", EffBalance: -0.5, Amount: big.NewInt(-500000)},
+		},
+	}
+	poolTkn := common.HexToAddress("0xaf88d065e77c8cc2239327c5edb3a432268e5831")
+	res.Attestation, err = Sign(key, 42161, 195984604, poolTkn, res.Result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// verify what a client receives
+	data, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received utils.APIBalancesResponse
+	if err := json.Unmarshal(data, &received); err != nil {
+		t.Fatal(err)
+	}
+	signer := crypto.PubkeyToAddress(key.PublicKey)
+	if err := Verify(&received, signer); err != nil {
+		t.Fatal(err)
+	}
+	received.Attestation.Amounts[0] = "3635689149"
+	if err := Verify(&received, signer); err == nil {
+		t.Fatal("expected verification failure for modified amount")
+	}
+}
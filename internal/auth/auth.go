@@ -0,0 +1,304 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+)
+
+const (
+	HEADER_API_KEY = "X-API-Key"
+	// keys are reloaded and usage is stored every SYNC_INTERVAL
+	SYNC_INTERVAL = 30 * time.Second
+)
+
+// Key is an API key with its rate limit
+type Key struct {
+	Name       string  `json:"name"`
+	Key        string  `json:"key,omitempty"` // plain key, only used in key files
+	Hash       string  `json:"-"`             // hex sha256 of the key
+	Capacity   int     `json:"capacity"`
+	RefillRate float64 `json:"refillRate"` // requests per second
+}
+
+// KeyInfo is the stored key including usage, listed by the admin command
+type KeyInfo struct {
+	Key
+	Usage      uint64
+	LastUsedOn *time.Time
+	CreatedOn  time.Time
+	RevokedOn  *time.Time
+}
+
+// client is an active key with its token bucket and usage counter
+type client struct {
+	key    Key
+	bucket *utils.TokenBucket
+	usage  atomic.Uint64 // requests not yet stored in the database
+}
+
+// Authenticator checks API keys and enforces per-key rate limits.
+// Keys are loaded from the database or from a JSON file.
+type Authenticator struct {
+	db         *sql.DB // nil if keys are loaded from a file
+	file       string
+	retryAfter int
+	mu         sync.RWMutex
+	clients    map[string]*client // key hash -> client
+	stop       chan struct{}
+}
+
+// NewDbAuthenticator creates an authenticator with the keys in the api_key table
+func NewDbAuthenticator(db *sql.DB, retryAfter int) (*Authenticator, error) {
+	a := Authenticator{db: db, retryAfter: retryAfter, clients: make(map[string]*client), stop: make(chan struct{})}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	go a.sync()
+	return &a, nil
+}
+
+// NewFileAuthenticator creates an authenticator with the keys of a JSON file
+// containing a list of keys [{"name": .., "key": .., "capacity": .., "refillRate": ..}]
+func NewFileAuthenticator(file string, retryAfter int) (*Authenticator, error) {
+	a := Authenticator{file: file, retryAfter: retryAfter, clients: make(map[string]*client), stop: make(chan struct{})}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	go a.sync()
+	return &a, nil
+}
+
+// Middleware rejects requests without valid API key with 401 and requests
+// exceeding the rate limit of the key with 429
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(HEADER_API_KEY)
+		if key == "" {
+			key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		a.mu.RLock()
+		c, exists := a.clients[HashKey(key)]
+		a.mu.RUnlock()
+		if key == "" || !exists {
+			writeError(w, http.StatusUnauthorized, utils.CODE_UNAUTHORIZED, "missing or invalid API key")
+			return
+		}
+		if !c.bucket.Take() {
+			w.Header().Set("Retry-After", strconv.Itoa(a.retryAfter))
+			writeError(w, http.StatusTooManyRequests, utils.CODE_RATE_LIMITED, "rate limit exceeded")
+			return
+		}
+		c.usage.Add(1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	jsonResponse, _ := json.Marshal(utils.APIError{Code: code, Message: msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonResponse)
+}
+
+// Usage returns the number of requests per key name since the last sync
+func (a *Authenticator) Usage() map[string]uint64 {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	usage := make(map[string]uint64, len(a.clients))
+	for _, c := range a.clients {
+		usage[c.key.Name] = c.usage.Load()
+	}
+	return usage
+}
+
+// sync periodically stores the usage and reloads the keys, so that keys
+// created or revoked with the admin command become effective
+func (a *Authenticator) sync() {
+	for {
+		select {
+		case <-time.After(SYNC_INTERVAL):
+		case <-a.stop:
+			return
+		}
+		if err := a.storeUsage(); err != nil {
+			slog.Error("storing api key usage:" + err.Error())
+		}
+		if err := a.reload(); err != nil {
+			slog.Error("reloading api keys:" + err.Error())
+		}
+	}
+}
+
+// Close stops the periodic sync and stores the remaining usage
+func (a *Authenticator) Close() error {
+	close(a.stop)
+	return a.storeUsage()
+}
+
+// reload loads the keys. Token buckets and usage of existing keys are kept.
+func (a *Authenticator) reload() error {
+	var keys []Key
+	var err error
+	if a.db != nil {
+		keys, err = loadDbKeys(a.db)
+	} else {
+		keys, err = loadFileKeys(a.file)
+	}
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	clients := make(map[string]*client, len(keys))
+	for _, k := range keys {
+		if c, exists := a.clients[k.Hash]; exists && c.key.Capacity == k.Capacity && c.key.RefillRate == k.RefillRate {
+			clients[k.Hash] = c
+			continue
+		}
+		c := client{key: k, bucket: utils.NewTokenBucket(k.Capacity, k.RefillRate)}
+		if old, exists := a.clients[k.Hash]; exists {
+			c.usage.Store(old.usage.Load())
+		}
+		clients[k.Hash] = &c
+	}
+	if len(clients) != len(a.clients) {
+		slog.Info(fmt.Sprintf("%d api keys active", len(clients)))
+	}
+	a.clients = clients
+	return nil
+}
+
+// storeUsage adds the usage counters to the database
+func (a *Authenticator) storeUsage() error {
+	if a.db == nil {
+		return nil
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for hash, c := range a.clients {
+		n := c.usage.Swap(0)
+		if n == 0 {
+			continue
+		}
+		query := `UPDATE api_key SET usage=usage+$1, last_used_on=now() WHERE key_hash=$2`
+		if _, err := a.db.Exec(query, n, hash); err != nil {
+			c.usage.Add(n)
+			return err
+		}
+	}
+	return nil
+}
+
+func loadDbKeys(db *sql.DB) ([]Key, error) {
+	query := `SELECT key_hash, name, capacity, refill_rate FROM api_key WHERE revoked_on IS NULL`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, errors.New("loadDbKeys:" + err.Error())
+	}
+	defer rows.Close()
+	keys := make([]Key, 0)
+	for rows.Next() {
+		var k Key
+		if err := rows.Scan(&k.Hash, &k.Name, &k.Capacity, &k.RefillRate); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func loadFileKeys(file string) ([]Key, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var keys []Key
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, errors.New("invalid api key file:" + err.Error())
+	}
+	for k := range keys {
+		if keys[k].Key == "" || keys[k].Capacity <= 0 || keys[k].RefillRate <= 0 {
+			return nil, fmt.Errorf("invalid api key entry %d (%s)", k, keys[k].Name)
+		}
+		keys[k].Hash = HashKey(keys[k].Key)
+		keys[k].Key = ""
+	}
+	return keys, nil
+}
+
+// HashKey returns the hex sha256 of the key
+func HashKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// CreateKey creates a new random API key with the given name and rate limit,
+// stores its hash and returns the plain key
+func CreateKey(db *sql.DB, name string, capacity int, refillRate float64) (string, error) {
+	if name == "" || capacity <= 0 || refillRate <= 0 {
+		return "", errors.New("name, capacity and refill rate required")
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	key := "d8x_" + hex.EncodeToString(b)
+	query := `INSERT INTO api_key(key_hash, name, capacity, refill_rate) VALUES($1, $2, $3, $4)`
+	if _, err := db.Exec(query, HashKey(key), name, capacity, refillRate); err != nil {
+		return "", errors.New("CreateKey:" + err.Error())
+	}
+	return key, nil
+}
+
+// RevokeKey revokes the active key with the given name
+func RevokeKey(db *sql.DB, name string) error {
+	res, err := db.Exec(`UPDATE api_key SET revoked_on=now() WHERE name=$1 AND revoked_on IS NULL`, name)
+	if err != nil {
+		return errors.New("RevokeKey:" + err.Error())
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("no active key with name " + name)
+	}
+	return nil
+}
+
+// ListKeys returns all keys including revoked ones
+func ListKeys(db *sql.DB) ([]KeyInfo, error) {
+	query := `SELECT name, capacity, refill_rate, usage, last_used_on, created_on, revoked_on FROM api_key ORDER BY created_on`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, errors.New("ListKeys:" + err.Error())
+	}
+	defer rows.Close()
+	keys := make([]KeyInfo, 0)
+	for rows.Next() {
+		var k KeyInfo
+		var lastUsed, revoked sql.NullTime
+		if err := rows.Scan(&k.Name, &k.Capacity, &k.RefillRate, &k.Usage, &lastUsed, &k.CreatedOn, &revoked); err != nil {
+			return nil, err
+		}
+		if lastUsed.Valid {
+			k.LastUsedOn = &lastUsed.Time
+		}
+		if revoked.Valid {
+			k.RevokedOn = &revoked.Time
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
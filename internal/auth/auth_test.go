@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileAuthenticatorMiddleware(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys.json")
+	err := os.WriteFile(file, []byte(`[{"name":"alice","key":"secret","capacity":2,"refillRate":0.001}]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewFileAuthenticator(file, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	request := func(header, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/get-balances", nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	if w := request("", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without key, got %d", w.Code)
+	}
+	if w := request(HEADER_API_KEY, "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for invalid key, got %d", w.Code)
+	}
+	if w := request(HEADER_API_KEY, "secret"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if w := request("Authorization", "Bearer secret"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 with bearer token, got %d", w.Code)
+	}
+	w := request(HEADER_API_KEY, "secret")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "7" {
+		t.Fatalf("expected 429 with Retry-After, got %d", w.Code)
+	}
+	if a.Usage()["alice"] != 2 {
+		t.Fatalf("unexpected usage %v", a.Usage())
+	}
+}
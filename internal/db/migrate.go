@@ -0,0 +1,38 @@
+package db
+
+import (
+	"github.com/golang-migrate/migrate/v4"
+	_ "github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+// Migrate runs the embedded migrations on the database
+func Migrate(postgresDSN string) error {
+	source, err := iofs.New(MigrationsFS, "migrations")
+	if err != nil {
+		return err
+	}
+	m, err := migrate.NewWithSourceInstance(
+		"MigrationsFS",
+		source,
+		postgresDSN,
+	)
+	if err != nil {
+		return err
+	}
+	if err := m.Up(); err != nil {
+		// Only return error if it's not "no change" error
+		if err.Error() != "no change" {
+			return err
+		}
+	}
+
+	e1, e2 := m.Close()
+	if e1 != nil {
+		return e1
+	}
+	if e2 != nil {
+		return e2
+	}
+	return nil
+}
@@ -0,0 +1,2 @@
+drop table if exists balance_snapshot_entry;
+drop table if exists balance_snapshot;
\ No newline at end of file
@@ -0,0 +1,22 @@
+-- CreateTable
+CREATE TABLE if not exists "balance_snapshot" (
+    "chain_id" INT NOT NULL,
+    "pool_id" INT NOT NULL,
+    "block" BIGINT NOT NULL,
+    "merkle_root" VARCHAR(66) NOT NULL,
+    "num_leaves" INT NOT NULL,
+    "created_on" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT "balance_snapshot_pkey" PRIMARY KEY ("chain_id", "pool_id", "block")
+);
+
+-- CreateTable
+CREATE TABLE if not exists "balance_snapshot_entry" (
+    "chain_id" INT NOT NULL,
+    "pool_id" INT NOT NULL,
+    "block" BIGINT NOT NULL,
+    "addr" VARCHAR(42) NOT NULL,
+    "amount" NUMERIC(78, 0) NOT NULL,
+    CONSTRAINT "balance_snapshot_entry_pkey" PRIMARY KEY ("chain_id", "pool_id", "block", "addr"),
+    CONSTRAINT "balance_snapshot_entry_fkey" FOREIGN KEY ("chain_id", "pool_id", "block")
+        REFERENCES "balance_snapshot"("chain_id", "pool_id", "block") ON DELETE CASCADE
+);
@@ -0,0 +1 @@
+drop table if exists balance_job;
\ No newline at end of file
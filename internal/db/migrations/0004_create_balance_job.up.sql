@@ -0,0 +1,16 @@
+-- CreateTable
+CREATE TABLE if not exists "balance_job" (
+    "id" VARCHAR(32) NOT NULL,
+    "chain_id" INT NOT NULL,
+    "status" VARCHAR(16) NOT NULL,
+    "request" JSONB NOT NULL,
+    "result" JSONB,
+    "error" TEXT,
+    "created_on" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "started_on" TIMESTAMPTZ,
+    "finished_on" TIMESTAMPTZ,
+    CONSTRAINT "balance_job_pkey" PRIMARY KEY ("id")
+);
+
+-- CreateIndex
+CREATE INDEX IF NOT EXISTS "balance_job_status_idx" ON "balance_job"("status", "created_on");
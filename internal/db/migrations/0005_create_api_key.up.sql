@@ -0,0 +1,15 @@
+-- CreateTable
+CREATE TABLE if not exists "api_key" (
+    "key_hash" VARCHAR(64) NOT NULL,
+    "name" VARCHAR(128) NOT NULL,
+    "capacity" INT NOT NULL,
+    "refill_rate" DOUBLE PRECISION NOT NULL,
+    "usage" BIGINT NOT NULL DEFAULT 0,
+    "last_used_on" TIMESTAMPTZ,
+    "created_on" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "revoked_on" TIMESTAMPTZ,
+    CONSTRAINT "api_key_pkey" PRIMARY KEY ("key_hash")
+);
+
+-- CreateIndex
+CREATE UNIQUE INDEX IF NOT EXISTS "api_key_name_idx" ON "api_key"("name") WHERE "revoked_on" IS NULL;
@@ -0,0 +1,8 @@
+-- CreateTable
+CREATE TABLE if not exists "indexer_cursor" (
+    "chain_id" INT NOT NULL,
+    "event" VARCHAR(16) NOT NULL,
+    "block" BIGINT NOT NULL,
+    "updated_on" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT "indexer_cursor_pkey" PRIMARY KEY ("chain_id", "event")
+);
@@ -0,0 +1,13 @@
+-- CreateTable
+CREATE TABLE if not exists "backfill_run" (
+    "chain_id" INT NOT NULL,
+    "event" VARCHAR(16) NOT NULL,
+    "from_block" BIGINT NOT NULL,
+    "to_block" BIGINT NOT NULL,
+    "shadow" BOOLEAN NOT NULL,
+    "done_block" BIGINT NOT NULL,
+    "status" VARCHAR(16) NOT NULL,
+    "created_on" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "updated_on" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT "backfill_run_pkey" PRIMARY KEY ("chain_id", "event", "from_block", "to_block", "shadow")
+);
@@ -0,0 +1,24 @@
+-- CreateTable
+CREATE TABLE if not exists "indexed_range" (
+    "id" BIGSERIAL NOT NULL,
+    "chain_id" INT NOT NULL,
+    "event" VARCHAR(16) NOT NULL,
+    "from_block" BIGINT NOT NULL,
+    "to_block" BIGINT NOT NULL,
+    "source" VARCHAR(16) NOT NULL,
+    "created_on" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT "indexed_range_pkey" PRIMARY KEY ("id")
+);
+
+-- CreateIndex
+CREATE INDEX IF NOT EXISTS "indexed_range_event_idx" ON "indexed_range"("chain_id", "event");
+
+-- events indexed before ranges were recorded are assumed complete
+INSERT INTO indexed_range(chain_id, event, from_block, to_block, source)
+SELECT chain_id, event, 0, max(block), 'legacy' FROM (
+    SELECT chain_id, 'transfer' AS event, max(to_block) AS block FROM sh_tkn_transfer GROUP BY chain_id
+    UNION ALL
+    SELECT chain_id, 'delegate' AS event, max(to_block) AS block FROM delegates GROUP BY chain_id
+    UNION ALL
+    SELECT chain_id, event, block FROM indexer_cursor
+) indexed GROUP BY chain_id, event;
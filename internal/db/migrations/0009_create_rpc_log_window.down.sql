@@ -0,0 +1 @@
+drop table if exists rpc_log_window;
@@ -0,0 +1,8 @@
+-- CreateTable
+CREATE TABLE if not exists "rpc_log_window" (
+    "chain_id" INT NOT NULL,
+    "endpoint" VARCHAR(256) NOT NULL,
+    "size" BIGINT NOT NULL,
+    "updated_on" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT "rpc_log_window_pkey" PRIMARY KEY ("chain_id", "endpoint")
+);
@@ -0,0 +1,5 @@
+drop table if exists perp_trade;
+drop table if exists perp_margin;
+drop table if exists perp_liquidation;
+delete from indexer_cursor where event in ('trade', 'deposit', 'withdrawal', 'liquidation', 'settlement');
+delete from indexed_range where event in ('trade', 'deposit', 'withdrawal', 'liquidation', 'settlement');
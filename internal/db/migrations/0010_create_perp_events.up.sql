@@ -0,0 +1,80 @@
+-- CreateTable
+CREATE TABLE if not exists "perp_trade" (
+    "chain_id" INT NOT NULL,
+    "pool_id" INT NOT NULL,
+    "perpetual_id" INT NOT NULL,
+    "trader" VARCHAR(42) NOT NULL,
+    "amount_bc" DOUBLE PRECISION NOT NULL,
+    "price" DOUBLE PRECISION NOT NULL,
+    "new_position_bc" DOUBLE PRECISION NOT NULL,
+    "fee_cc" DOUBLE PRECISION NOT NULL,
+    "pnl_cc" DOUBLE PRECISION NOT NULL,
+    "order_digest" VARCHAR(66) NOT NULL,
+    "block" BIGINT NOT NULL,
+    "tx_hash" VARCHAR(66) NOT NULL,
+    "log_index" INT NOT NULL,
+    "to_block" BIGINT NOT NULL,
+    "created_on" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT "perp_trade_pkey" PRIMARY KEY ("chain_id", "tx_hash", "log_index")
+);
+
+-- deposits, withdrawals and settlements
+CREATE TABLE if not exists "perp_margin" (
+    "chain_id" INT NOT NULL,
+    "pool_id" INT NOT NULL,
+    "perpetual_id" INT NOT NULL,
+    "trader" VARCHAR(42) NOT NULL,
+    "kind" VARCHAR(16) NOT NULL,
+    "amount_cc" DOUBLE PRECISION NOT NULL,
+    "block" BIGINT NOT NULL,
+    "tx_hash" VARCHAR(66) NOT NULL,
+    "log_index" INT NOT NULL,
+    "to_block" BIGINT NOT NULL,
+    "created_on" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT "perp_margin_pkey" PRIMARY KEY ("chain_id", "tx_hash", "log_index")
+);
+
+CREATE TABLE if not exists "perp_liquidation" (
+    "chain_id" INT NOT NULL,
+    "pool_id" INT NOT NULL,
+    "perpetual_id" INT NOT NULL,
+    "trader" VARCHAR(42) NOT NULL,
+    "liquidator" VARCHAR(42) NOT NULL,
+    "amount_bc" DOUBLE PRECISION NOT NULL,
+    "price" DOUBLE PRECISION NOT NULL,
+    "new_position_bc" DOUBLE PRECISION NOT NULL,
+    "fee_cc" DOUBLE PRECISION NOT NULL,
+    "pnl_cc" DOUBLE PRECISION NOT NULL,
+    "block" BIGINT NOT NULL,
+    "tx_hash" VARCHAR(66) NOT NULL,
+    "log_index" INT NOT NULL,
+    "to_block" BIGINT NOT NULL,
+    "created_on" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT "perp_liquidation_pkey" PRIMARY KEY ("chain_id", "tx_hash", "log_index")
+);
+
+-- CreateIndex
+CREATE INDEX IF NOT EXISTS "perp_trade_trader_idx" ON "perp_trade"("chain_id", "pool_id", "trader", "block");
+CREATE INDEX IF NOT EXISTS "perp_trade_block_idx" ON "perp_trade"("chain_id", "pool_id", "block");
+CREATE INDEX IF NOT EXISTS "perp_margin_trader_idx" ON "perp_margin"("chain_id", "pool_id", "trader", "block");
+CREATE INDEX IF NOT EXISTS "perp_margin_block_idx" ON "perp_margin"("chain_id", "pool_id", "kind", "block");
+CREATE INDEX IF NOT EXISTS "perp_liquidation_trader_idx" ON "perp_liquidation"("chain_id", "pool_id", "trader", "block");
+CREATE INDEX IF NOT EXISTS "perp_liquidation_block_idx" ON "perp_liquidation"("chain_id", "pool_id", "block");
+
+-- the new event types are indexed from the current indexed block on, the blocks since
+-- the genesis block are gaps that the range repair (or a backfill) fills. As in 0008, the
+-- indexed block of the balance events is the greatest of the stored events and the cursor,
+-- the cursor is still empty when upgrading from a version before 0006.
+INSERT INTO indexer_cursor(chain_id, event, block)
+SELECT indexed.chain_id, e.event, min(indexed.block) FROM (
+    SELECT chain_id, src, max(block) AS block FROM (
+        SELECT chain_id, 'transfer' AS src, max(to_block) AS block FROM sh_tkn_transfer GROUP BY chain_id
+        UNION ALL
+        SELECT chain_id, 'delegate' AS src, max(to_block) AS block FROM delegates GROUP BY chain_id
+        UNION ALL
+        SELECT chain_id, event AS src, block FROM indexer_cursor WHERE event IN ('delegate', 'transfer')
+    ) blocks GROUP BY chain_id, src
+) indexed
+CROSS JOIN (VALUES ('trade'), ('deposit'), ('withdrawal'), ('liquidation'), ('settlement')) AS e(event)
+GROUP BY indexed.chain_id, e.event
+ON CONFLICT DO NOTHING;
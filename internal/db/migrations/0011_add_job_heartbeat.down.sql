@@ -0,0 +1 @@
+ALTER TABLE "balance_job" DROP COLUMN IF EXISTS "heartbeat_on";
@@ -0,0 +1 @@
+ALTER TABLE "balance_job" ADD COLUMN IF NOT EXISTS "heartbeat_on" TIMESTAMPTZ;
@@ -0,0 +1,7 @@
+-- CreateTable
+CREATE TABLE if not exists "indexer_leader" (
+    "chain_id" INT NOT NULL,
+    "epoch" BIGINT NOT NULL,
+    "updated_on" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT "indexer_leader_pkey" PRIMARY KEY ("chain_id")
+);
@@ -0,0 +1,7 @@
+-- CreateTable
+CREATE TABLE if not exists "filter_run" (
+    "chain_id" INT NOT NULL,
+    "run" JSONB NOT NULL,
+    "updated_on" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT "filter_run_pkey" PRIMARY KEY ("chain_id")
+);
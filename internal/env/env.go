@@ -7,6 +7,11 @@ const (
 	DATABASE_DSN  = "DATABASE_DSN"
 	API_PORT      = "API_PORT"
 	API_BIND_ADDR = "API_BIND_ADDR"
+	// optional hex private key to sign balance responses (EIP-712)
+	SIGNING_KEY = "SIGNING_KEY"
+	// optional API key authentication: "db" or "file"
+	API_AUTH      = "API_AUTH"
+	API_KEYS_FILE = "API_KEYS_FILE"
 
 	// global constant
 	DELEGATE_IDX_STRATEGY = 2
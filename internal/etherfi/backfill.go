@@ -0,0 +1,292 @@
+package etherfi
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/D8-X/d8x-etherfi/internal/filterer"
+	"github.com/D8-X/d8x-etherfi/internal/leader"
+)
+
+const (
+	BACKFILL_RUNNING   = "running"
+	BACKFILL_COMPLETED = "completed"
+	SHADOW_SUFFIX      = "_shadow"
+)
+
+// BackfillOptions configures a backfill run
+type BackfillOptions struct {
+	From   uint64
+	To     uint64
+	Events []string // EVENT_DELEGATE and/or EVENT_TRANSFER
+	DryRun bool     // only report the events found and the rows that would be replaced
+	Resume bool     // continue an interrupted run with the same parameters
+	Shadow bool     // rebuild into a shadow table that replaces the table when done
+}
+
+// Backfill re-indexes the events in the block range [From, To]. The chunks of the range are
+// filtered in parallel, the events of each chunk replace the stored events of the chunk in one
+// transaction and in block order, so that a run can be repeated or resumed without duplicates.
+func (app *App) Backfill(ctx context.Context, opts BackfillOptions) error {
+	if opts.From == 0 {
+		return errors.New("Backfill: from block required")
+	}
+	if opts.To < opts.From {
+		return errors.New("Backfill: to block must not be below from block")
+	}
+	for _, event := range opts.Events {
+		if eventIdx(event) < 0 {
+			return fmt.Errorf("Backfill: unknown event type %s", event)
+		}
+	}
+	for _, event := range opts.Events {
+		if err := app.backfillEvent(ctx, opts, event); err != nil {
+			return fmt.Errorf("Backfill %s:%w", event, err)
+		}
+	}
+	return nil
+}
+
+// backfillSteps are the storage and chain operations of a backfill run
+type backfillSteps struct {
+	indexed func(event string) (uint64, error)
+	start   func(opts BackfillOptions, event string) (uint64, error)
+	filter  func(ctx context.Context, eventType filterer.EventType, from, to uint64, handle filterer.ChunkHandler) (uint64, error)
+	count   func(table, event string, from, to uint64) (int, error)
+	replace func(table, event string, from, to uint64, events filterer.Events, run *BackfillOptions) (int, error)
+	swap    func(event string, opts BackfillOptions) error
+	finish  func(event string, opts BackfillOptions) error
+}
+
+func (app *App) backfillSteps() backfillSteps {
+	return backfillSteps{
+		indexed: app.dbGetIndexedBlock,
+		start:   app.dbStartBackfill,
+		filter: func(ctx context.Context, eventType filterer.EventType, from, to uint64, handle filterer.ChunkHandler) (uint64, error) {
+			return app.Filterer.FilterEventsParallel(ctx, []filterer.EventType{eventType}, from, to, app.Config.FilterWorkers, handle)
+		},
+		count: app.dbCountRange,
+		replace: func(table, event string, from, to uint64, events filterer.Events, run *BackfillOptions) (int, error) {
+			return app.dbReplaceRange(table, event, from, to, events, RANGE_BACKFILL, run)
+		},
+		swap:   app.dbSwapShadow,
+		finish: app.dbFinishBackfill,
+	}
+}
+
+func (app *App) backfillEvent(ctx context.Context, opts BackfillOptions, event string) error {
+	return app.backfillSteps().run(ctx, opts, event)
+}
+
+func (s backfillSteps) run(ctx context.Context, opts BackfillOptions, event string) error {
+	indexed, err := s.indexed(event)
+	if err != nil {
+		return err
+	}
+	if opts.To > indexed {
+		// new blocks are indexed by the indexer, which advances the cursor
+		return fmt.Errorf("to block %d above indexed block %d", opts.To, indexed)
+	}
+	h := indexedEvents[eventIdx(event)]
+	table := h.table()
+	start := opts.From
+	if !opts.DryRun {
+		start, err = s.start(opts, event)
+		if err != nil {
+			return err
+		}
+		if opts.Shadow {
+			table += SHADOW_SUFFIX
+		}
+	}
+	if start > opts.From {
+		slog.Info(fmt.Sprintf("resuming %s backfill at block %d", event, start))
+	}
+	var numEvents, numRows int
+	handle := func(events filterer.Events, from, to uint64) error {
+		found := events.Len(h.eventType())
+		numEvents += found
+		if opts.DryRun {
+			n, err := s.count(table, event, from, to)
+			if err != nil {
+				return err
+			}
+			numRows += n
+			slog.Info(fmt.Sprintf("dry-run %s blocks %d-%d: %d events found, %d rows stored", event, from, to, found, n))
+			return nil
+		}
+		n, err := s.replace(table, event, from, to, events, &opts)
+		if err != nil {
+			return err
+		}
+		slog.Info(fmt.Sprintf("backfilled %s blocks %d-%d: %d events", event, from, to, n))
+		return nil
+	}
+	if start <= opts.To {
+		last, err := s.filter(ctx, h.eventType(), start, opts.To, handle)
+		if errors.Is(err, context.Canceled) {
+			return fmt.Errorf("interrupted at block %d, run again to resume", last+1)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if opts.DryRun {
+		slog.Info(fmt.Sprintf("dry-run %s blocks %d-%d: %d events found, %d rows stored", event, opts.From, opts.To, numEvents, numRows))
+		return nil
+	}
+	if opts.Shadow {
+		if err := s.swap(event, opts); err != nil {
+			return err
+		}
+		slog.Info(fmt.Sprintf("swapped %s into %s", table, h.table()))
+	}
+	return s.finish(event, opts)
+}
+
+// dbStartBackfill registers the run and returns the block to start from. Without
+// resume, or if the previous run with the same parameters completed, the run starts
+// over and the shadow table is recreated.
+func (app *App) dbStartBackfill(opts BackfillOptions, event string) (uint64, error) {
+	chainId := app.Sdk.ChainConfig.ChainId
+	if opts.Resume {
+		var done uint64
+		var status string
+		query := `SELECT done_block, status FROM backfill_run
+			WHERE chain_id=$1 AND event=$2 AND from_block=$3 AND to_block=$4 AND shadow=$5`
+		err := app.Db.QueryRow(query, chainId, event, opts.From, opts.To, opts.Shadow).Scan(&done, &status)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, err
+		}
+		if err == nil && status == BACKFILL_RUNNING {
+			return done + 1, nil
+		}
+	}
+	tx, err := app.Db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if opts.Shadow {
+		table := indexedEvents[eventIdx(event)].table()
+		shadow := table + SHADOW_SUFFIX
+		if _, err := tx.Exec(`DROP TABLE IF EXISTS ` + shadow); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`CREATE TABLE ` + shadow + ` (LIKE ` + table + ` INCLUDING ALL)`); err != nil {
+			return 0, err
+		}
+	}
+	query := `INSERT INTO backfill_run(chain_id, event, from_block, to_block, shadow, done_block, status)
+		VALUES($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (chain_id, event, from_block, to_block, shadow)
+		DO UPDATE SET done_block=EXCLUDED.done_block, status=EXCLUDED.status, updated_on=CURRENT_TIMESTAMP`
+	_, err = tx.Exec(query, chainId, event, opts.From, opts.To, opts.Shadow, opts.From-1, BACKFILL_RUNNING)
+	if err != nil {
+		return 0, err
+	}
+	return opts.From, tx.Commit()
+}
+
+// dbReplaceRange replaces the events of the blocks [from, to], records the range and
+// checkpoints the backfill run (if any) in one transaction. Returns the number of stored events.
+// Ranges of a shadow run are recorded by dbSwapShadow, once the shadow table is in place.
+func (app *App) dbReplaceRange(table, event string, from, to uint64, events filterer.Events, source string, run *BackfillOptions) (int, error) {
+	h := indexedEvents[eventIdx(event)]
+	tx, err := app.dbBeginIndexTx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	scope, args := h.scope(app)
+	n := len(args)
+	query := fmt.Sprintf(`DELETE FROM %s WHERE %s AND block BETWEEN $%d AND $%d`, table, scope, n+1, n+2)
+	if _, err := tx.Exec(query, append(args, from, to)...); err != nil {
+		return 0, err
+	}
+	stored, err := h.store(app, tx, table, events, from, to)
+	if err != nil {
+		return 0, err
+	}
+	if run == nil || !run.Shadow {
+		if err := app.dbRecordRange(tx, event, from, to, source); err != nil {
+			return 0, err
+		}
+	}
+	if run != nil {
+		query = `UPDATE backfill_run SET done_block=$6, updated_on=CURRENT_TIMESTAMP
+			WHERE chain_id=$1 AND event=$2 AND from_block=$3 AND to_block=$4 AND shadow=$5`
+		_, err = tx.Exec(query, app.Sdk.ChainConfig.ChainId, event, run.From, run.To, run.Shadow, to)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return stored, tx.Commit()
+}
+
+// dbCountRange counts the stored events of the blocks [from, to]
+func (app *App) dbCountRange(table, event string, from, to uint64) (int, error) {
+	scope, args := indexedEvents[eventIdx(event)].scope(app)
+	n := len(args)
+	query := fmt.Sprintf(`SELECT count(*) FROM %s WHERE %s AND block BETWEEN $%d AND $%d`, table, scope, n+1, n+2)
+	var count int
+	err := app.Db.QueryRow(query, append(args, from, to)...).Scan(&count)
+	return count, err
+}
+
+// dbSwapShadow copies all rows outside the backfilled range into the shadow table
+// and replaces the table by the shadow table in one transaction, which also records the
+// backfilled range. The indexer must not
+// run during the swap: the transaction takes the leader lock and fails if it is held.
+func (app *App) dbSwapShadow(event string, opts BackfillOptions) error {
+	h := indexedEvents[eventIdx(event)]
+	table := h.table()
+	shadow := table + SHADOW_SUFFIX
+	tx, err := app.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var locked bool
+	err = tx.QueryRow(`SELECT pg_try_advisory_xact_lock($1, $2)`, leader.LOCK_CLASS, app.Sdk.ChainConfig.ChainId).Scan(&locked)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return errors.New("the indexer is running, stop it to swap the shadow table and run again to resume")
+	}
+	if _, err := tx.Exec(`LOCK TABLE ` + table + ` IN ACCESS EXCLUSIVE MODE`); err != nil {
+		return err
+	}
+	scope, args := h.scope(app)
+	n := len(args)
+	query := fmt.Sprintf(`INSERT INTO %s SELECT * FROM %s WHERE NOT (%s AND block BETWEEN $%d AND $%d)`,
+		shadow, table, scope, n+1, n+2)
+	if _, err := tx.Exec(query, append(args, opts.From, opts.To)...); err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		`ALTER TABLE ` + table + ` RENAME TO ` + table + `_old`,
+		`ALTER TABLE ` + shadow + ` RENAME TO ` + table,
+		`DROP TABLE ` + table + `_old`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if err := app.dbRecordRange(tx, event, opts.From, opts.To, RANGE_BACKFILL); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// dbFinishBackfill marks the run as completed
+func (app *App) dbFinishBackfill(event string, opts BackfillOptions) error {
+	query := `UPDATE backfill_run SET status=$6, updated_on=CURRENT_TIMESTAMP
+		WHERE chain_id=$1 AND event=$2 AND from_block=$3 AND to_block=$4 AND shadow=$5`
+	_, err := app.Db.Exec(query, app.Sdk.ChainConfig.ChainId, event, opts.From, opts.To, opts.Shadow, BACKFILL_COMPLETED)
+	return err
+}
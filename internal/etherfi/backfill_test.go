@@ -0,0 +1,136 @@
+package etherfi
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/D8-X/d8x-etherfi/internal/filterer"
+)
+
+func TestBackfillOptionsValidation(t *testing.T) {
+	app := &App{}
+	cases := []BackfillOptions{
+		{From: 0, To: 10, Events: []string{EVENT_TRANSFER}},
+		{From: 20, To: 10, Events: []string{EVENT_TRANSFER}},
+		{From: 1, To: 10, Events: []string{"swap"}},
+	}
+	for _, opts := range cases {
+		if err := app.Backfill(context.Background(), opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+}
+
+// fakeBackfill keeps the backfill run in memory and filters chunks of 10
+// blocks. The filter is canceled after the chunk ending at cancelAt.
+type fakeBackfill struct {
+	done     uint64
+	running  bool
+	cancelAt uint64
+	filtered []uint64 // start blocks passed to the filter
+	replaced []string
+	counted  []string
+	swapped  bool
+	finished bool
+}
+
+func (f *fakeBackfill) steps() backfillSteps {
+	return backfillSteps{
+		indexed: func(event string) (uint64, error) { return 1000, nil },
+		start: func(opts BackfillOptions, event string) (uint64, error) {
+			if opts.Resume && f.running {
+				return f.done + 1, nil
+			}
+			f.done, f.running = opts.From-1, true
+			return opts.From, nil
+		},
+		filter: func(ctx context.Context, eventType filterer.EventType, from, to uint64, handle filterer.ChunkHandler) (uint64, error) {
+			f.filtered = append(f.filtered, from)
+			last := from - 1
+			for b := from; b <= to; b += 10 {
+				if err := handle(nil, b, min(b+9, to)); err != nil {
+					return last, err
+				}
+				last = min(b+9, to)
+				if last == f.cancelAt {
+					return last, context.Canceled
+				}
+			}
+			return last, nil
+		},
+		count: func(table, event string, from, to uint64) (int, error) {
+			f.counted = append(f.counted, fmt.Sprintf("%s:%d-%d", table, from, to))
+			return 0, nil
+		},
+		replace: func(table, event string, from, to uint64, events filterer.Events, run *BackfillOptions) (int, error) {
+			f.replaced = append(f.replaced, fmt.Sprintf("%s:%d-%d", table, from, to))
+			f.done = to
+			return 0, nil
+		},
+		swap: func(event string, opts BackfillOptions) error {
+			f.swapped = true
+			return nil
+		},
+		finish: func(event string, opts BackfillOptions) error {
+			f.running, f.finished = false, true
+			return nil
+		},
+	}
+}
+
+func TestBackfillResume(t *testing.T) {
+	f := &fakeBackfill{cancelAt: 20}
+	opts := BackfillOptions{From: 1, To: 40, Events: []string{EVENT_TRANSFER}}
+	err := f.steps().run(context.Background(), opts, EVENT_TRANSFER)
+	if err == nil || !strings.Contains(err.Error(), "interrupted at block 21") {
+		t.Fatalf("expected interruption at block 21, got %v", err)
+	}
+	if f.done != 20 || f.finished {
+		t.Fatalf("expected checkpoint at block 20, got %d (finished %v)", f.done, f.finished)
+	}
+	f.cancelAt = 0
+	opts.Resume = true
+	if err := f.steps().run(context.Background(), opts, EVENT_TRANSFER); err != nil {
+		t.Fatal(err)
+	}
+	table := indexedEvents[eventIdx(EVENT_TRANSFER)].table()
+	want := []string{table + ":1-10", table + ":11-20", table + ":21-30", table + ":31-40"}
+	if !slices.Equal(f.filtered, []uint64{1, 21}) || !slices.Equal(f.replaced, want) || !f.finished {
+		t.Fatalf("unexpected resume: filtered %v, replaced %v, finished %v", f.filtered, f.replaced, f.finished)
+	}
+	if f.swapped {
+		t.Fatal("swapped without shadow")
+	}
+}
+
+func TestBackfillDryRun(t *testing.T) {
+	// a dry run ignores the interrupted run and only counts
+	f := &fakeBackfill{done: 20, running: true}
+	opts := BackfillOptions{From: 1, To: 25, Events: []string{EVENT_TRANSFER}, DryRun: true, Resume: true, Shadow: true}
+	if err := f.steps().run(context.Background(), opts, EVENT_TRANSFER); err != nil {
+		t.Fatal(err)
+	}
+	table := indexedEvents[eventIdx(EVENT_TRANSFER)].table()
+	want := []string{table + ":1-10", table + ":11-20", table + ":21-25"}
+	if !slices.Equal(f.filtered, []uint64{1}) || !slices.Equal(f.counted, want) {
+		t.Fatalf("unexpected dry-run: filtered %v, counted %v", f.filtered, f.counted)
+	}
+	if len(f.replaced) > 0 || f.swapped || f.finished || f.done != 20 {
+		t.Fatalf("dry-run modified the run: replaced %v, swapped %v, finished %v, done %d", f.replaced, f.swapped, f.finished, f.done)
+	}
+}
+
+func TestBackfillShadow(t *testing.T) {
+	f := &fakeBackfill{}
+	opts := BackfillOptions{From: 1, To: 15, Events: []string{EVENT_TRANSFER}, Shadow: true}
+	if err := f.steps().run(context.Background(), opts, EVENT_TRANSFER); err != nil {
+		t.Fatal(err)
+	}
+	shadow := indexedEvents[eventIdx(EVENT_TRANSFER)].table() + SHADOW_SUFFIX
+	if !slices.Equal(f.replaced, []string{shadow + ":1-10", shadow + ":11-15"}) || !f.swapped || !f.finished {
+		t.Fatalf("unexpected shadow run: replaced %v, swapped %v, finished %v", f.replaced, f.swapped, f.finished)
+	}
+}
@@ -0,0 +1,140 @@
+package etherfi
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+	"golang.org/x/sync/singleflight"
+)
+
+// CacheStats are the counters of the balance cache
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Coalesced uint64 `json:"coalesced"` // requests answered by a computation shared with identical requests
+	Entries   int    `json:"entries"`
+}
+
+// balanceCache collapses identical concurrent balance computations and keeps the
+// results for finalized blocks in a bounded LRU cache with a TTL
+type balanceCache struct {
+	maxEntries int
+	ttl        time.Duration
+	mu         sync.Mutex
+	lru        *list.List // front: most recently used
+	entries    map[string]*list.Element
+	group      singleflight.Group
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+	coalesced  atomic.Uint64
+}
+
+type cacheEntry struct {
+	key     string
+	res     []utils.Balance
+	expires time.Time
+}
+
+func newBalanceCache(maxEntries int, ttl time.Duration) *balanceCache {
+	return &balanceCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// balanceKey identifies a computation by block and address set
+func balanceKey(req utils.APIBalancesPayload) string {
+	addrs := make([]string, len(req.Addresses))
+	copy(addrs, req.Addresses)
+	sort.Strings(addrs)
+	h := sha256.New()
+	for _, a := range addrs {
+		h.Write([]byte(strings.ToLower(a)))
+	}
+	return strconv.FormatUint(req.BlockNumber, 10) + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns the cached balances for the key if present and not expired
+func (c *balanceCache) get(key string) ([]utils.Balance, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, exists := c.entries[key]
+	if !exists {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e.res, true
+}
+
+// put adds the balances to the cache and evicts the least recently used
+// entries if the cache is full
+func (c *balanceCache) put(key string, res []utils.Balance) {
+	if c.maxEntries <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, exists := c.entries[key]; exists {
+		c.lru.Remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, res: res, expires: time.Now().Add(c.ttl)})
+	for c.lru.Len() > c.maxEntries {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*cacheEntry).key)
+	}
+}
+
+// do returns the cached balances or runs compute. Concurrent calls with the same
+// key share one computation. Results are only cached if cacheable is true.
+func (c *balanceCache) do(key string, cacheable bool, compute func() ([]utils.Balance, error)) ([]utils.Balance, error) {
+	if cacheable {
+		if res, ok := c.get(key); ok {
+			c.hits.Add(1)
+			return res, nil
+		}
+	}
+	c.misses.Add(1)
+	v, err, shared := c.group.Do(key, func() (interface{}, error) {
+		res, err := compute()
+		if err == nil && cacheable {
+			c.put(key, res)
+		}
+		return res, err
+	})
+	if shared {
+		c.coalesced.Add(1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.([]utils.Balance), nil
+}
+
+func (c *balanceCache) stats() CacheStats {
+	c.mu.Lock()
+	n := c.lru.Len()
+	c.mu.Unlock()
+	return CacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Coalesced: c.coalesced.Load(),
+		Entries:   n,
+	}
+}
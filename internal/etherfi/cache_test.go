@@ -0,0 +1,73 @@
+package etherfi
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+)
+
+func TestBalanceCacheCoalescing(t *testing.T) {
+	c := newBalanceCache(10, time.Minute)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	compute := func() ([]utils.Balance, error) {
+		calls.Add(1)
+		<-release
+		return []utils.Balance{{Address: "0x01"}}, nil
+	}
+	var wg sync.WaitGroup
+	for k := 0; k < 5; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.do("k", false, compute)
+		}()
+	}
+	// let all requests join before the computation completes
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls.Load() != 1 {
+		t.Fatalf("expected 1 computation, got %d", calls.Load())
+	}
+	if c.stats().Entries != 0 {
+		t.Fatal("non-cacheable result was cached")
+	}
+}
+
+func TestBalanceCacheLimits(t *testing.T) {
+	c := newBalanceCache(2, 50*time.Millisecond)
+	compute := func() ([]utils.Balance, error) {
+		return []utils.Balance{}, nil
+	}
+	c.do("a", true, compute)
+	c.do("b", true, compute)
+	c.do("a", true, compute) // hit, a becomes most recently used
+	c.do("c", true, compute) // evicts b
+	if _, ok := c.get("b"); ok {
+		t.Fatal("expected b to be evicted")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+	s := c.stats()
+	if s.Hits != 1 || s.Misses != 3 || s.Entries != 2 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := c.get("a"); ok {
+		t.Fatal("expected a to be expired")
+	}
+}
+
+func TestBalanceKey(t *testing.T) {
+	k1 := balanceKey(utils.APIBalancesPayload{BlockNumber: 1, Addresses: []string{"0xa", "0xb"}})
+	k2 := balanceKey(utils.APIBalancesPayload{BlockNumber: 1, Addresses: []string{"0xb", "0xa"}, Limit: 5})
+	k3 := balanceKey(utils.APIBalancesPayload{BlockNumber: 2, Addresses: []string{"0xa", "0xb"}})
+	if k1 != k2 || k1 == k3 {
+		t.Fatal("unexpected balance keys")
+	}
+}
@@ -2,11 +2,16 @@ package etherfi
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
+	"math/big"
 
 	"github.com/D8-X/d8x-etherfi/internal/env"
 	"github.com/D8-X/d8x-etherfi/internal/filterer"
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+	d8xutils "github.com/D8-X/d8x-futures-go-sdk/utils"
 )
 
 // dbGetShareTokenHolders looks for all addresses that have
@@ -29,53 +34,172 @@ func (app *App) dbGetShareTokenHolders(blockNum uint64) ([]string, error) {
 }
 
 // DBGetLatestBlock looks for the last block for which data has been
-// collected for both the delegation and transfer events
+// collected for the delegation and transfer events
 func (app *App) DBGetLatestBlock() uint64 {
-	return min(app.DbGetDelegateStartBlock(), app.DbGetShTknTransferStartBlock())
+	var latest uint64
+	for k, event := range balanceEvents {
+		block := app.DbGetIndexedBlock(event)
+		if k == 0 || block < latest {
+			latest = block
+		}
+	}
+	return latest
 }
 
-// DbGetStartBlock looks up the latest block for which
-// we have stored receiver addresses
-func (app *App) DbGetShTknTransferStartBlock() uint64 {
-	if app.LastBlockTo[1] == 0 {
-		query := `SELECT coalesce(max(to_block),0) FROM sh_tkn_transfer WHERE chain_id=$1`
-		var block uint64
-		err := app.Db.QueryRow(query, app.Sdk.ChainConfig.ChainId).Scan(&block)
-		if err == sql.ErrNoRows {
+// DbGetIndexedBlock looks up the latest block for which
+// events of the given type are stored
+func (app *App) DbGetIndexedBlock(event string) uint64 {
+	k := eventIdx(event)
+	if app.LastBlockTo[k].Load() == 0 {
+		block, err := app.dbGetIndexedBlock(event)
+		if err != nil {
+			slog.Error("Error for DbGetIndexedBlock" + err.Error())
 			return block
 		}
+		// a concurrent update from the indexer or a reload is newer
+		app.LastBlockTo[k].CompareAndSwap(0, max(app.Genesis, block))
+	}
+	return app.LastBlockTo[k].Load()
+}
+
+// DBReloadIndexedBlocks reads the blocks up to which events were indexed by
+// another process (API replicas that do not index themselves, followers)
+func (app *App) DBReloadIndexedBlocks() error {
+	for k, h := range indexedEvents {
+		block, err := app.dbGetIndexedBlock(h.event())
 		if err != nil {
-			slog.Error("Error for DbGetStartBlock" + err.Error())
-			return block
+			return errors.New("DBReloadIndexedBlocks:" + err.Error())
 		}
-		app.LastBlockTo[1] = max(app.Genesis, block)
+		app.LastBlockTo[k].Store(max(app.Genesis, block))
 	}
-	return app.LastBlockTo[1]
+	return nil
 }
 
-// DbGetStartBlock looks up the latest block for which
-// we have stored receiver addresses
-func (app *App) DbGetDelegateStartBlock() uint64 {
-	if app.LastBlockTo[0] == 0 {
-		query := `SELECT coalesce(max(to_block),0) FROM delegates WHERE chain_id=$1`
-		var block uint64
-		err := app.Db.QueryRow(query, app.Sdk.ChainConfig.ChainId).Scan(&block)
-		if err == sql.ErrNoRows {
-			return block
+// dbGetIndexedBlock returns the block up to which the given event type is indexed.
+// The cursor also advances for ranges without events, the to_block of the
+// event table covers data indexed before the cursor table existed.
+func (app *App) dbGetIndexedBlock(event string) (uint64, error) {
+	k := eventIdx(event)
+	if k < 0 {
+		return 0, errors.New("unknown event type " + event)
+	}
+	scope, args := indexedEvents[k].scope(app)
+	query := fmt.Sprintf(`SELECT greatest(
+			(SELECT coalesce(max(to_block),0) FROM %s WHERE %s),
+			(SELECT coalesce(max(block),0) FROM indexer_cursor WHERE chain_id=$1 AND event=$%d))`,
+		indexedEvents[k].table(), scope, len(args)+1)
+	var block uint64
+	err := app.Db.QueryRow(query, append(args, event)...).Scan(&block)
+	if err != nil {
+		return 0, err
+	}
+	return block, nil
+}
+
+// dbBeginIndexTx starts a transaction for indexed events. With leader election,
+// the transaction fails unless this instance still holds the leader lock.
+func (app *App) dbBeginIndexTx() (*sql.Tx, error) {
+	tx, err := app.Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if app.Leader != nil {
+		if err := app.Leader.Fence(tx); err != nil {
+			tx.Rollback()
+			return nil, err
 		}
+	}
+	return tx, nil
+}
+
+// dbAdvanceCursor sets the block up to which the event type is indexed
+func (app *App) dbAdvanceCursor(tx *sql.Tx, event string, toBlock uint64) error {
+	query := `INSERT INTO indexer_cursor(chain_id, event, block) VALUES($1, $2, $3)
+		ON CONFLICT (chain_id, event) DO UPDATE SET block=greatest(indexer_cursor.block, EXCLUDED.block), updated_on=CURRENT_TIMESTAMP`
+	_, err := tx.Exec(query, app.Sdk.ChainConfig.ChainId, event, toBlock)
+	return err
+}
+
+// dbRecordRange records that the events of the blocks [from, to] are stored. Ranges
+// of the indexer that continue the previous range extend it.
+func (app *App) dbRecordRange(tx *sql.Tx, event string, from, to uint64, source string) error {
+	chainId := app.Sdk.ChainConfig.ChainId
+	if source == RANGE_INDEXER {
+		query := `UPDATE indexed_range SET to_block=$4 WHERE id=(SELECT max(id) FROM indexed_range
+			WHERE chain_id=$1 AND event=$2 AND source='` + RANGE_INDEXER + `' AND to_block=$3)`
+		res, err := tx.Exec(query, chainId, event, from-1, to)
 		if err != nil {
-			slog.Error("Error for DbGetStartBlock" + err.Error())
-			return block
+			return err
 		}
-		app.LastBlockTo[0] = max(app.Genesis, block)
+		if n, _ := res.RowsAffected(); n > 0 {
+			return nil
+		}
+	}
+	query := `INSERT INTO indexed_range(chain_id, event, from_block, to_block, source) VALUES($1, $2, $3, $4, $5)`
+	_, err := tx.Exec(query, chainId, event, from, to, source)
+	return err
+}
+
+// dbGetIndexedRanges returns the recorded ranges of the event type
+func (app *App) dbGetIndexedRanges(event string) ([]indexedRange, error) {
+	query := `SELECT id, from_block, to_block, source FROM indexed_range WHERE chain_id=$1 AND event=$2 ORDER BY id`
+	rows, err := app.Db.Query(query, app.Sdk.ChainConfig.ChainId, event)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ranges := make([]indexedRange, 0)
+	for rows.Next() {
+		var r indexedRange
+		if err := rows.Scan(&r.id, &r.rng.From, &r.rng.To, &r.source); err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, rows.Err()
+}
+
+// DBInsertEvents inserts the events of the blocks [fromBlock, toBlock] into the database in one
+// transaction, so that an interruption cannot leave a partial range behind. Event types are only
+// stored from their start block on (the block after their cursor), for each stored event type the
+// range is recorded and the cursor advances to toBlock, also without events. Returns the number
+// of stored events per event type.
+func (app *App) DBInsertEvents(events filterer.Events, starts map[string]uint64, fromBlock, toBlock uint64) (map[string]int, error) {
+	tx, err := app.dbBeginIndexTx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	stored := make(map[string]int, len(starts))
+	for _, h := range indexedEvents {
+		event := h.event()
+		start, exists := starts[event]
+		if !exists || start > toBlock {
+			continue
+		}
+		from := max(fromBlock, start)
+		n, err := h.store(app, tx, h.table(), events, from, toBlock)
+		if err != nil {
+			return nil, err
+		}
+		if err := app.dbRecordRange(tx, event, from, toBlock, RANGE_INDEXER); err != nil {
+			return nil, err
+		}
+		if err := app.dbAdvanceCursor(tx, event, toBlock); err != nil {
+			return nil, err
+		}
+		stored[event] = n
 	}
-	return app.LastBlockTo[0]
+	return stored, tx.Commit()
 }
 
-// DBInsertShTknTransfer inserts the results FSResultSet for flipsGetPoolShrTknHolders into the database
-func (app *App) DBInsertShTknTransfer(transfers []interface{}, toBlock uint64) error {
+// dbInsertTransferRows inserts transfers into the given transfer table. All rows of the
+// transaction share created_on, so identical transfers in one block are stored once, which
+// is sufficient since transfers are only read for the set of recipients.
+func (app *App) dbInsertTransferRows(tx *sql.Tx, table string, transfers []filterer.Transfer, toBlock uint64) error {
 	// Prepare the insert statement
-	stmt, err := app.Db.Prepare(`INSERT INTO sh_tkn_transfer("from", "to", block, to_block, sh_tkn, chain_id) VALUES($1, $2, $3, $4, $5, $6)`)
+	stmt, err := tx.Prepare(`INSERT INTO ` + table + `("from", "to", block, to_block, sh_tkn, chain_id) VALUES($1, $2, $3, $4, $5, $6)
+		ON CONFLICT DO NOTHING`)
 	if err != nil {
 		return err
 	}
@@ -83,29 +207,26 @@ func (app *App) DBInsertShTknTransfer(transfers []interface{}, toBlock uint64) e
 	chainId := app.Sdk.ChainConfig.ChainId
 	tkn_addr := app.PoolShareTknAddr.Hex()
 	// Insert each address
-	for _, row := range transfers {
-		transfer := row.(filterer.Transfer)
+	for _, transfer := range transfers {
 		_, err := stmt.Exec(transfer.From, transfer.To, transfer.BlockNr, toBlock, tkn_addr, chainId)
 		if err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
 
-// DBInsertDelegates inserts the delegate array into the database
-func (app *App) DBInsertDelegates(delegates []interface{}, toBlock uint64) error {
+// dbInsertDelegateRows inserts delegate events into the given delegate table
+func (app *App) dbInsertDelegateRows(tx *sql.Tx, table string, delegates []filterer.Delegate, toBlock uint64) error {
 	// Prepare the insert statement
-	stmt, err := app.Db.Prepare("INSERT INTO delegates(addr, delegate, block, index, to_block, chain_id) VALUES($1, $2, $3, $4, $5, $6)")
+	stmt, err := tx.Prepare("INSERT INTO " + table + "(addr, delegate, block, index, to_block, chain_id) VALUES($1, $2, $3, $4, $5, $6)")
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 	chainId := app.Sdk.ChainConfig.ChainId
 	// Insert each event
-	for _, row := range delegates {
-		dlgt := row.(filterer.Delegate)
+	for _, dlgt := range delegates {
 		_, err := stmt.Exec(dlgt.Addr, dlgt.Delegate, dlgt.BlockNr, dlgt.Index, toBlock, chainId)
 		if err != nil {
 			return err
@@ -134,6 +255,64 @@ func (app *App) DbFindStrategyDelegates(toBlock uint64) ([]string, []string, err
 	return addr, delegate, nil
 }
 
+// dbStoreFilterRun stores the result of the last filter cycle
+func (app *App) dbStoreFilterRun(run utils.FilterRun) error {
+	data, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO filter_run(chain_id, run) VALUES($1, $2)
+		ON CONFLICT (chain_id) DO UPDATE SET run=EXCLUDED.run, updated_on=CURRENT_TIMESTAMP`
+	_, err = app.Db.Exec(query, app.Sdk.ChainConfig.ChainId, data)
+	return err
+}
+
+// dbGetFilterRun returns the stored result of the last filter cycle, nil if none
+func (app *App) dbGetFilterRun() (*utils.FilterRun, error) {
+	var data []byte
+	query := `SELECT run FROM filter_run WHERE chain_id=$1`
+	err := app.Db.QueryRow(query, app.Sdk.ChainConfig.ChainId).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New("dbGetFilterRun:" + err.Error())
+	}
+	var run utils.FilterRun
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, errors.New("dbGetFilterRun:" + err.Error())
+	}
+	return &run, nil
+}
+
+// LoadLogWindows returns the learned log query windows per rpc endpoint
+func (app *App) LoadLogWindows() (map[string]uint64, error) {
+	query := `SELECT endpoint, size FROM rpc_log_window WHERE chain_id=$1`
+	rows, err := app.Db.Query(query, app.Sdk.ChainConfig.ChainId)
+	if err != nil {
+		return nil, errors.New("LoadLogWindows:" + err.Error())
+	}
+	defer rows.Close()
+	sizes := make(map[string]uint64)
+	for rows.Next() {
+		var endpoint string
+		var size uint64
+		if err := rows.Scan(&endpoint, &size); err != nil {
+			return nil, errors.New("LoadLogWindows:" + err.Error())
+		}
+		sizes[endpoint] = size
+	}
+	return sizes, rows.Err()
+}
+
+// StoreLogWindow stores the learned log query window of the rpc endpoint
+func (app *App) StoreLogWindow(endpoint string, size uint64) error {
+	query := `INSERT INTO rpc_log_window(chain_id, endpoint, size) VALUES($1, $2, $3)
+		ON CONFLICT (chain_id, endpoint) DO UPDATE SET size=EXCLUDED.size, updated_on=CURRENT_TIMESTAMP`
+	_, err := app.Db.Exec(query, app.Sdk.ChainConfig.ChainId, endpoint, size)
+	return err
+}
+
 // ConnectDB connects to the database and assigns the connection to the app struct
 func (a *App) ConnectDB(connStr string) error {
 	// Connect to database
@@ -147,3 +326,61 @@ func (a *App) ConnectDB(connStr string) error {
 	a.Db = db
 	return nil
 }
+
+// dbInsertSnapshot stores the snapshot and its entries in one transaction
+func (app *App) dbInsertSnapshot(snap utils.APISnapshotResponse, entries []utils.Balance) error {
+	tx, err := app.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	chainId := app.Sdk.ChainConfig.ChainId
+	// replace a previously stored snapshot for the same block
+	_, err = tx.Exec(`DELETE FROM balance_snapshot WHERE chain_id=$1 AND pool_id=$2 AND block=$3`, chainId, app.PoolId, snap.BlockNumber)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO balance_snapshot(chain_id, pool_id, block, merkle_root, num_leaves) VALUES($1, $2, $3, $4, $5)`,
+		chainId, app.PoolId, snap.BlockNumber, snap.MerkleRoot, snap.NumLeaves)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO balance_snapshot_entry(chain_id, pool_id, block, addr, amount) VALUES($1, $2, $3, $4, $5)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, e := range entries {
+		_, err := stmt.Exec(chainId, app.PoolId, snap.BlockNumber, e.Address, e.Amount.String())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// dbGetSnapshotEntries returns the stored entries of the snapshot at the given block
+func (app *App) dbGetSnapshotEntries(blockNum uint64) ([]utils.Balance, error) {
+	query := `SELECT addr, amount::text FROM balance_snapshot_entry WHERE chain_id=$1 AND pool_id=$2 AND block=$3`
+	rows, err := app.Db.Query(query, app.Sdk.ChainConfig.ChainId, app.PoolId, blockNum)
+	if err != nil {
+		return nil, errors.New("dbGetSnapshotEntries:" + err.Error())
+	}
+	defer rows.Close()
+	entries := make([]utils.Balance, 0)
+	for rows.Next() {
+		var a, amount string
+		if err := rows.Scan(&a, &amount); err != nil {
+			return nil, errors.New("dbGetSnapshotEntries:" + err.Error())
+		}
+		amt, ok := new(big.Int).SetString(amount, 10)
+		if !ok {
+			return nil, errors.New("dbGetSnapshotEntries: invalid amount " + amount)
+		}
+		entries = append(entries, utils.Balance{Address: a, EffBalance: d8xutils.DecNToFloat(amt, app.PoolTknDecimals), Amount: amt})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.New("dbGetSnapshotEntries:" + err.Error())
+	}
+	return entries, nil
+}
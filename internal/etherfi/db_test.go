@@ -0,0 +1,99 @@
+package etherfi
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/D8-X/d8x-etherfi/internal/db"
+	"github.com/D8-X/d8x-etherfi/internal/filterer"
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+	"github.com/D8-X/d8x-futures-go-sdk/pkg/d8x_futures"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// TEST_CHAIN_ID separates the rows of database tests from other data
+const TEST_CHAIN_ID = 999_001
+
+// testApp returns an app connected to the migrated database TEST_DATABASE_DSN,
+// the test is skipped if the variable is not set
+func testApp(t *testing.T) *App {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN not set")
+	}
+	if err := db.Migrate(dsn); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	app := &App{
+		Db:               conn,
+		Sdk:              &d8x_futures.SdkRO{},
+		PoolShareTknAddr: common.HexToAddress("0x35751007a407ca6feffe80b3cb397736d2cf4dbe"),
+	}
+	app.Sdk.ChainConfig.ChainId = TEST_CHAIN_ID
+	return app
+}
+
+func TestInsertIdenticalTransfers(t *testing.T) {
+	app := testApp(t)
+	remove := func() {
+		app.Db.Exec(`DELETE FROM sh_tkn_transfer WHERE chain_id=$1`, TEST_CHAIN_ID)
+	}
+	remove()
+	t.Cleanup(remove)
+	// two identical transfers in one block of the chunk
+	transfer := filterer.Transfer{
+		From:    "0x0000000000000000000000000000000000000001",
+		To:      "0x0000000000000000000000000000000000000002",
+		BlockNr: 100,
+	}
+	tx, err := app.dbBeginIndexTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	err = app.dbInsertTransferRows(tx, TABLE_TRANSFER, []filterer.Transfer{transfer, transfer}, 200)
+	if err != nil {
+		t.Fatalf("identical transfers rejected: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	holders, err := app.dbGetShareTokenHolders(200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(holders) != 1 || holders[0] != transfer.To {
+		t.Fatalf("unexpected holders %v", holders)
+	}
+}
+
+func TestFilterRunShared(t *testing.T) {
+	indexer := testApp(t)
+	remove := func() {
+		indexer.Db.Exec(`DELETE FROM filter_run WHERE chain_id=$1`, TEST_CHAIN_ID)
+	}
+	remove()
+	t.Cleanup(remove)
+	// an API replica without indexer
+	replica := &App{Db: indexer.Db, Sdk: indexer.Sdk}
+	if run := replica.lastFilterRun(); run != nil {
+		t.Fatalf("unexpected run %+v", run)
+	}
+	indexer.recordFilterRun(utils.FilterRun{
+		StartedOn:  time.Unix(1716631200, 0).UTC(),
+		FinishedOn: time.Unix(1716631260, 0).UTC(),
+		Events:     map[string]int{EVENT_TRANSFER: 3},
+		Ok:         true,
+	})
+	run := replica.lastFilterRun()
+	if run == nil || !run.Ok || run.Events[EVENT_TRANSFER] != 3 || !run.FinishedOn.Equal(time.Unix(1716631260, 0)) {
+		t.Fatalf("unexpected run %+v", run)
+	}
+}
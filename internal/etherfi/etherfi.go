@@ -1,27 +1,37 @@
 package etherfi
 
 import (
+	"context"
+	"crypto/ecdsa"
 	"database/sql"
 	"errors"
 	"fmt"
 	"log/slog"
 	"math/big"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/D8-X/d8x-etherfi/internal/attest"
 	"github.com/D8-X/d8x-etherfi/internal/env"
 	"github.com/D8-X/d8x-etherfi/internal/filterer"
+	"github.com/D8-X/d8x-etherfi/internal/jobs"
+	"github.com/D8-X/d8x-etherfi/internal/leader"
+	"github.com/D8-X/d8x-etherfi/internal/metrics"
 	"github.com/D8-X/d8x-etherfi/internal/utils"
 	"github.com/D8-X/d8x-futures-go-sdk/pkg/d8x_futures"
 	d8xutils "github.com/D8-X/d8x-futures-go-sdk/utils"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/spf13/viper"
 )
 
 type App struct {
+	Config           utils.Config
 	Db               *sql.DB
 	Genesis          uint64 // starting block when no data
 	PerpProxy        common.Address
@@ -32,11 +42,22 @@ type App struct {
 	PoolTknDecimals  uint8
 	RpcMngr          utils.RpcHandler
 	Filterer         *filterer.Filterer
+	Leader           *leader.Elector // elects the instance that indexes, nil to always index
 	Mutex            sync.Mutex
 	Sdk              *d8x_futures.SdkRO
-	LastBlockTo      [2]uint64 // last block-to query. 0:delegates 1: transfers
-	EtherfiAPY       float64   //APY for etherfi
-	EtherfiAPYTs     int64     //unix timestamp when etherfi APY was last queried
+	LastBlockTo      []atomic.Uint64   // last block-to query per event type, in the order of indexedEvents; read by the handlers, written by the indexer
+	EtherfiAPY       float64           //APY for etherfi
+	EtherfiAPYTs     int64             //unix timestamp when etherfi APY was last queried
+	SigningKey       *ecdsa.PrivateKey // optional key to sign balance responses
+	Jobs             *jobs.Manager     // asynchronous balance jobs
+	cache            *balanceCache
+	latest           latestBalances
+	snapshots        snapshotTrees    // trees of recently queried snapshots
+	admission        *utils.Admission // limits concurrent balance computations
+	ready            readiness
+	filterRuns       filterRuns
+	rangeChecks      rangeChecks
+	background       sync.WaitGroup // background computations, awaited on shutdown
 }
 
 func NewApp(v *viper.Viper) (*App, error) {
@@ -66,6 +87,7 @@ func NewApp(v *viper.Viper) (*App, error) {
 	}
 
 	app := App{
+		Config:           config,
 		PerpProxy:        config.PerpAddr,
 		Genesis:          config.Genesis,
 		PoolId:           uint16(config.PoolId),
@@ -73,17 +95,21 @@ func NewApp(v *viper.Viper) (*App, error) {
 		PoolShareTknAddr: shareTkn,
 		PoolTknAddr:      marginTkn,
 		Sdk:              &sdkRo,
+		LastBlockTo:      make([]atomic.Uint64, len(indexedEvents)),
+		cache:            newBalanceCache(config.CacheMaxEntries, time.Duration(config.CacheTtlSec)*time.Second),
+		admission:        utils.NewAdmission(config.MaxBalanceCalcs, config.MaxBalanceQueue, time.Duration(config.BalanceQueueSec)*time.Second),
 	}
 
 	if app.PoolShareTknAddr == (common.Address{}) || app.PoolTknAddr == (common.Address{}) {
 		return nil, errors.New("invalid token address")
 	}
-	f, err := filterer.NewFilterer(config.RpcUrlsFltr, config.PerpAddr, app.PoolShareTknAddr)
+	f, err := filterer.NewFilterer(config.RpcUrlsFltr, config.RpcBudgetFltr, config.PerpAddr, app.PoolShareTknAddr)
 	if err != nil {
 		return nil, errors.New("failed to create filterer:" + err.Error())
 	}
+	f.SetWindowLimits(config.RpcLogWindows)
 	app.Filterer = f
-	err = app.RpcMngr.Init(config.RpcUrls, 5, 5)
+	err = app.RpcMngr.Init(config.RpcUrls, config.RpcBudget.Capacity, config.RpcBudget.RefillRate)
 	if err != nil {
 		return nil, err
 	}
@@ -92,13 +118,145 @@ func NewApp(v *viper.Viper) (*App, error) {
 		return nil, err
 	}
 	app.PoolTknDecimals = dec
+	// trader history of the perpetuals of the pool
+	if err := f.RegisterPerpEvents(perpIds, dec); err != nil {
+		return nil, errors.New("failed to register perpetual events:" + err.Error())
+	}
 
+	if key := v.GetString(env.SIGNING_KEY); key != "" {
+		app.SigningKey, err = crypto.HexToECDSA(strings.TrimPrefix(key, "0x"))
+		if err != nil {
+			return nil, errors.New("invalid signing key:" + err.Error())
+		}
+		slog.Info("balance responses are signed by " + crypto.PubkeyToAddress(app.SigningKey.PublicKey).Hex())
+	}
 	return &app, nil
 }
 
-// Balances responds to the balance query. Precondition: event data
+// StartJobs starts the workers for asynchronous balance jobs.
+// Precondition: the database is connected
+func (app *App) StartJobs(ctx context.Context) {
+	retention := time.Duration(app.Config.JobRetentionMins) * time.Minute
+	app.Jobs = jobs.NewManager(app.Db, app.Sdk.ChainConfig.ChainId, app.BalancesResult, app.Config.JobWorkers, app.Config.JobMaxQueued, retention)
+	app.Jobs.Start(ctx)
+}
+
+// Wait waits until the background computations and the job workers
+// stopped, or until ctx is done
+func (app *App) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		app.background.Wait()
+		if app.Jobs != nil {
+			app.Jobs.Wait()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close closes the database and the rpc connections
+func (app *App) Close() {
+	if app.Db != nil {
+		if err := app.Db.Close(); err != nil {
+			slog.Error("closing db:" + err.Error())
+		}
+	}
+	app.RpcMngr.Close()
+	if app.Filterer != nil {
+		app.Filterer.RpcMngr.Close()
+	}
+}
+
+// Balances responds to the balance query. Identical concurrent queries share
+// one computation and results for finalized blocks are cached, hence the
+// returned balances must not be modified. Precondition: event data
 // has been gathered up to the requested block
 func (app *App) Balances(req utils.APIBalancesPayload) (utils.APIBalancesResponse, error) {
+	if r, ok := app.latestBalancesFor(req); ok {
+		return r, nil
+	}
+	cacheable := req.BlockNumber+app.Config.CacheFinality <= app.DBGetLatestBlock()
+	bal, err := app.cache.do(balanceKey(req), cacheable, func() ([]utils.Balance, error) {
+		bal := make([]utils.Balance, 0)
+		err := app.StreamBalances(req, func(b utils.Balance) error {
+			bal = append(bal, b)
+			return nil
+		})
+		return bal, err
+	})
+	if err != nil {
+		return utils.APIBalancesResponse{}, err
+	}
+	var r utils.APIBalancesResponse
+	r.Result = bal
+	if len(req.Addresses) > 0 {
+		// a shared result can stem from a query with a different address order
+		byAddr := make(map[string]utils.Balance, len(bal))
+		for _, b := range bal {
+			byAddr[b.Address] = b
+		}
+		r.Result = make([]utils.Balance, 0, len(req.Addresses))
+		for _, a := range req.Addresses {
+			r.Result = append(r.Result, byAddr[a])
+		}
+	}
+	return r, nil
+}
+
+// CacheStats returns the hit and miss counts of the balance cache
+func (app *App) CacheStats() CacheStats {
+	return app.cache.stats()
+}
+
+// BalancesResult calculates the balances of the query, sorts and pages them
+// as requested and adds the attestation. The holder universe is always sorted
+// to get a stable order, explicit addresses keep the requested order unless
+// sorting is requested. Returns ctx.Err() if ctx is canceled before the
+// result is complete.
+func (app *App) BalancesResult(ctx context.Context, req utils.APIBalancesPayload) (utils.APIBalancesResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return utils.APIBalancesResponse{}, err
+	}
+	res, err := app.Balances(req)
+	if err != nil {
+		return utils.APIBalancesResponse{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return utils.APIBalancesResponse{}, err
+	}
+	if req.IsPaged() || len(req.Addresses) == 0 {
+		res.Result, res.NextCursor, err = utils.PageBalances(req, res.Result)
+		if err != nil {
+			return utils.APIBalancesResponse{}, err
+		}
+	}
+	err = app.AttestBalances(&res, req.BlockNumber)
+	if err != nil {
+		return utils.APIBalancesResponse{}, errors.New("could not sign balances:" + err.Error())
+	}
+	return res, nil
+}
+
+// StreamBalances calculates the balances for the query and passes them one by one
+// to emit. All RPC queries are completed before the first balance is emitted.
+// Returns utils.ErrOverloaded if too many computations are running.
+// Precondition: event data has been gathered up to the requested block
+func (app *App) StreamBalances(req utils.APIBalancesPayload, emit func(utils.Balance) error) error {
+	if err := app.admission.Acquire(); err != nil {
+		return err
+	}
+	defer app.admission.Release()
+	return app.streamBalances(req, emit)
+}
+
+// streamBalances calculates the balances without admission control
+func (app *App) streamBalances(req utils.APIBalancesPayload, emit func(utils.Balance) error) error {
 
 	addr := req.Addresses
 	var err error
@@ -108,7 +266,7 @@ func (app *App) Balances(req utils.APIBalancesPayload) (utils.APIBalancesRespons
 		// Get list of all token holders
 		addr, err = app.dbGetShareTokenHolders(req.BlockNumber)
 		if err != nil {
-			return utils.APIBalancesResponse{}, err
+			return err
 		}
 	}
 	time0 := time.Now()
@@ -120,18 +278,21 @@ func (app *App) Balances(req utils.APIBalancesPayload) (utils.APIBalancesRespons
 		ShTknBal   []*big.Int
 		ShTknTotal *big.Int
 	}
-	errChan := make(chan error)
-	traderChan := make(chan TraderChan)
-	lpChan := make(chan LpChan)
+	// buffered so that no go routine is left blocked if we return early
+	errChan := make(chan error, 2)
+	traderChan := make(chan TraderChan, 1)
+	lpChan := make(chan LpChan, 1)
 	go func() {
 		traderBalcs, total, err := app.QueryTraderBalances(big.NewInt(int64(req.BlockNumber)))
 		if err != nil {
 			slog.Error("Unable to get trader balances:" + err.Error())
-			errChan <- err
+			errChan <- utils.NewRpcUnavailableError(err)
+			return
 		}
 		err = app.reassignTraderBalances(traderBalcs, req.BlockNumber)
 		if err != nil {
 			errChan <- err
+			return
 		}
 		traderChan <- TraderChan{TraderBal: traderBalcs, Total: total}
 	}()
@@ -139,7 +300,8 @@ func (app *App) Balances(req utils.APIBalancesPayload) (utils.APIBalancesRespons
 	go func() {
 		lpBalcs, shTknTot, err := app.QueryLpBalances(addr, req.BlockNumber)
 		if err != nil {
-			errChan <- err
+			errChan <- utils.NewRpcUnavailableError(err)
+			return
 		}
 		lpChan <- LpChan{ShTknBal: lpBalcs, ShTknTotal: shTknTot}
 	}()
@@ -155,23 +317,34 @@ func (app *App) Balances(req utils.APIBalancesPayload) (utils.APIBalancesRespons
 			fmt.Println("found ", len(lp.ShTknBal), "LPs")
 		case err := <-errChan:
 			if err != nil {
-				return utils.APIBalancesResponse{}, err
+				return err
 			}
 		}
 	}
 	// attribute lp balances based on totals
 	lpBal, err := app.attributeLpBalances(lp.ShTknBal, lp.ShTknTotal, t.Total, req.BlockNumber)
 	if err != nil {
-		return utils.APIBalancesResponse{}, err
+		return utils.NewRpcUnavailableError(err)
 	}
+	fmt.Println("\ntime elapsed = ", time.Since(time0))
+	metrics.BalancesDuration.Observe(time.Since(time0).Seconds())
 	// combine balances. If addresses were provided we report the balance for each of those addresses,
 	// even if zero.
-	balances := combineBalances(addr, len(req.Addresses) > 0, lpBal, t.TraderBal, app.PoolTknDecimals)
-	fmt.Println("\ntime elapsed = ", time.Since(time0))
-	var r utils.APIBalancesResponse
-	r.Result = balances
-	// create
-	return r, nil
+	return combineBalances(addr, len(req.Addresses) > 0, lpBal, t.TraderBal, app.PoolTknDecimals, emit)
+}
+
+// AttestBalances adds the EIP-712 attestation to the balance response
+// if a signing key is configured
+func (app *App) AttestBalances(res *utils.APIBalancesResponse, blockNumber uint64) error {
+	if app.SigningKey == nil {
+		return nil
+	}
+	att, err := attest.Sign(app.SigningKey, app.Sdk.ChainConfig.ChainId, blockNumber, app.PoolTknAddr, res.Result)
+	if err != nil {
+		return err
+	}
+	res.Attestation = att
+	return nil
 }
 
 // reassignTraderBalances re-assigns balances from the 'trader-account' to the 'delegate' in
@@ -200,9 +373,9 @@ func (app *App) reassignTraderBalances(traderBal map[string]*big.Int, block uint
 	return nil
 }
 
-// combineBalances goes through all the addresses and reconciles the balances
-func combineBalances(addrs []string, exactAddr bool, lpBal []*big.Int, traderBal map[string]*big.Int, decN uint8) []utils.Balance {
-	balances := make([]utils.Balance, 0, len(addrs)+len(traderBal))
+// combineBalances goes through all the addresses, reconciles the balances and
+// passes each balance to emit
+func combineBalances(addrs []string, exactAddr bool, lpBal []*big.Int, traderBal map[string]*big.Int, decN uint8, emit func(utils.Balance) error) error {
 	z := big.NewInt(0)
 	for k, addr := range addrs {
 		bal := new(big.Int).Set(lpBal[k])
@@ -212,14 +385,18 @@ func combineBalances(addrs []string, exactAddr bool, lpBal []*big.Int, traderBal
 		}
 		if bal.Cmp(z) == 0 {
 			if exactAddr {
-				balances = append(balances, utils.Balance{Address: addr, EffBalance: 0})
+				if err := emit(utils.Balance{Address: addr, EffBalance: 0, Amount: bal}); err != nil {
+					return err
+				}
 			}
 			continue
 		}
-		balances = append(balances, utils.Balance{Address: addr, EffBalance: d8xutils.DecNToFloat(bal, decN)})
+		if err := emit(utils.Balance{Address: addr, EffBalance: d8xutils.DecNToFloat(bal, decN), Amount: bal}); err != nil {
+			return err
+		}
 	}
 	if exactAddr {
-		return balances
+		return nil
 	}
 	// exactAddr=false and we have to add all WEETH owners to the list
 	// hence, we also add the traders to the list. traders that are also LPs were set to zero in the
@@ -228,9 +405,11 @@ func combineBalances(addrs []string, exactAddr bool, lpBal []*big.Int, traderBal
 		if bal.Cmp(z) == 0 {
 			continue
 		}
-		balances = append(balances, utils.Balance{Address: addr, EffBalance: d8xutils.DecNToFloat(bal, decN)})
+		if err := emit(utils.Balance{Address: addr, EffBalance: d8xutils.DecNToFloat(bal, decN), Amount: bal}); err != nil {
+			return err
+		}
 	}
-	return balances
+	return nil
 }
 
 func retryQuery(blockNumber uint64, rpcManager *utils.RpcHandler, queryFunc func(uint64, *ethclient.Client) (*big.Int, error)) (*big.Int, error) {
@@ -246,6 +425,7 @@ func retryQuery(blockNumber uint64, rpcManager *utils.RpcHandler, queryFunc func
 		if err.Error() == "no contract code at given address" {
 			return big.NewInt(0), nil
 		}
+		rpcManager.ReportError(rpc, trial < 3)
 		slog.Info("query failed, retrying")
 	}
 	return result, err
@@ -272,6 +452,7 @@ func (app *App) QueryLpBalances(addrs []string, blockNumber uint64) ([]*big.Int,
 		if err == nil {
 			break
 		}
+		app.RpcMngr.ReportError(rpc, trial < 2)
 		time.Sleep(2 * time.Second)
 	}
 	if err != nil {
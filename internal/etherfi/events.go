@@ -0,0 +1,120 @@
+package etherfi
+
+import (
+	"database/sql"
+
+	"github.com/D8-X/d8x-etherfi/internal/filterer"
+)
+
+// eventIndex indexes one event type: the filterer decodes its logs, the index
+// stores the events into its table, and its name keys the cursor and the
+// recorded ranges of the event type
+type eventIndex interface {
+	event() string
+	table() string
+	eventType() filterer.EventType
+	// scope returns the condition for the rows of this app in the table,
+	// with parameters $1 (and $2)
+	scope(app *App) (string, []any)
+	// store inserts the events at or after block from into the table and
+	// returns the number of stored events
+	store(app *App, tx *sql.Tx, table string, events filterer.Events, from, toBlock uint64) (int, error)
+}
+
+// typedIndex is the eventIndex of events of type T
+type typedIndex[T filterer.Event] struct {
+	name    string
+	tbl     string
+	kind    filterer.Kind[T]
+	scopeFn func(app *App) (string, []any)
+	insert  func(app *App, tx *sql.Tx, table string, rows []T, toBlock uint64) error
+}
+
+// newIndex returns the index of the events of the kind, stored into table with insert
+func newIndex[T filterer.Event](
+	event, table string,
+	kind filterer.Kind[T],
+	scope func(app *App) (string, []any),
+	insert func(app *App, tx *sql.Tx, table string, rows []T, toBlock uint64) error,
+) eventIndex {
+	return typedIndex[T]{name: event, tbl: table, kind: kind, scopeFn: scope, insert: insert}
+}
+
+func (h typedIndex[T]) event() string {
+	return h.name
+}
+
+func (h typedIndex[T]) table() string {
+	return h.tbl
+}
+
+func (h typedIndex[T]) eventType() filterer.EventType {
+	return filterer.EventType(h.kind)
+}
+
+func (h typedIndex[T]) scope(app *App) (string, []any) {
+	return h.scopeFn(app)
+}
+
+func (h typedIndex[T]) store(app *App, tx *sql.Tx, table string, events filterer.Events, from, toBlock uint64) (int, error) {
+	rows := eventsFrom(filterer.Decoded(events, h.kind), from)
+	return len(rows), h.insert(app, tx, table, rows, toBlock)
+}
+
+// indexedEvents are the indexed event types, in the order of App.LastBlockTo.
+// A new event type is indexed by registering its decoder with the filterer
+// and adding its index here.
+var indexedEvents = []eventIndex{
+	newIndex(EVENT_DELEGATE, TABLE_DELEGATE, filterer.DelegateKind, chainScope, (*App).dbInsertDelegateRows),
+	newIndex(EVENT_TRANSFER, TABLE_TRANSFER, filterer.TransferKind, shareTokenScope, (*App).dbInsertTransferRows),
+	newIndex(EVENT_TRADE, TABLE_TRADE, filterer.TradeKind, poolScope, (*App).dbInsertTradeRows),
+	newIndex(EVENT_DEPOSIT, TABLE_MARGIN, filterer.DepositKind, marginScope(EVENT_DEPOSIT), marginInsert(EVENT_DEPOSIT)),
+	newIndex(EVENT_WITHDRAW, TABLE_MARGIN, filterer.WithdrawKind, marginScope(EVENT_WITHDRAW), marginInsert(EVENT_WITHDRAW)),
+	newIndex(EVENT_LIQUIDATION, TABLE_LIQUIDATION, filterer.LiquidateKind, poolScope, (*App).dbInsertLiquidationRows),
+	newIndex(EVENT_SETTLEMENT, TABLE_MARGIN, filterer.SettleKind, marginScope(EVENT_SETTLEMENT), marginInsert(EVENT_SETTLEMENT)),
+}
+
+// balanceEvents are the event types the balances are computed from
+var balanceEvents = []string{EVENT_DELEGATE, EVENT_TRANSFER}
+
+// eventIdx returns the position of the event type in indexedEvents, -1 if unknown
+func eventIdx(event string) int {
+	for k, h := range indexedEvents {
+		if h.event() == event {
+			return k
+		}
+	}
+	return -1
+}
+
+// eventTypesOf returns the filterer event types of the events in starts
+func eventTypesOf(starts map[string]uint64) []filterer.EventType {
+	eventTypes := make([]filterer.EventType, 0, len(starts))
+	for _, h := range indexedEvents {
+		if _, exists := starts[h.event()]; exists {
+			eventTypes = append(eventTypes, h.eventType())
+		}
+	}
+	return eventTypes
+}
+
+// chainScope selects the rows of the chain
+func chainScope(app *App) (string, []any) {
+	return "chain_id=$1", []any{app.Sdk.ChainConfig.ChainId}
+}
+
+// shareTokenScope selects the rows of the chain and pool share token
+func shareTokenScope(app *App) (string, []any) {
+	return "chain_id=$1 AND sh_tkn=$2", []any{app.Sdk.ChainConfig.ChainId, app.PoolShareTknAddr.Hex()}
+}
+
+// eventsFrom returns the events at or after the block
+func eventsFrom[T filterer.Event](events []T, block uint64) []T {
+	from := make([]T, 0, len(events))
+	for _, e := range events {
+		if e.Block() >= block {
+			from = append(from, e)
+		}
+	}
+	return from
+}
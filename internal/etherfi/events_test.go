@@ -0,0 +1,31 @@
+package etherfi
+
+import (
+	"testing"
+
+	"github.com/D8-X/d8x-etherfi/internal/filterer"
+)
+
+func TestIndexedEvents(t *testing.T) {
+	seen := make(map[filterer.EventType]bool)
+	for k, h := range indexedEvents {
+		if eventIdx(h.event()) != k {
+			t.Fatalf("event %s registered twice", h.event())
+		}
+		if seen[h.eventType()] {
+			t.Fatalf("event type %v indexed twice", h.eventType())
+		}
+		seen[h.eventType()] = true
+	}
+	if eventIdx("unknown") != -1 {
+		t.Fatal("unknown event found")
+	}
+}
+
+func TestEventsFrom(t *testing.T) {
+	transfers := []filterer.Transfer{{BlockNr: 9}, {BlockNr: 10}, {BlockNr: 11}}
+	from := eventsFrom(transfers, 10)
+	if len(from) != 2 || from[0].BlockNr != 10 || from[1].BlockNr != 11 {
+		t.Fatalf("unexpected events %+v", from)
+	}
+}
@@ -192,6 +192,7 @@ func (app *App) tryQueryAvailCash(opts *bind.CallOpts, id *big.Int, addrs []comm
 		}
 		res, err := caller.Call(opts, calls...)
 		if err != nil {
+			app.RpcMngr.ReportError(client, false)
 			return nil, err
 		}
 
@@ -222,6 +223,7 @@ func (app *App) queryActiveAddr(opts *bind.CallOpts, perpId int32) ([]common.Add
 		if err == nil {
 			break
 		}
+		app.RpcMngr.ReportError(client, trial < 2)
 	}
 	if err != nil {
 		return nil, err
@@ -0,0 +1,94 @@
+package etherfi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+)
+
+const (
+	// readiness results are reused for READY_CACHE to limit the load
+	// of frequent probes on the database and the rpcs
+	READY_CACHE   = 10 * time.Second
+	PROBE_TIMEOUT = 5 * time.Second
+)
+
+type readiness struct {
+	mu      sync.Mutex // guards checked and status
+	probing sync.Mutex // held while the probes run
+	checked time.Time
+	status  utils.APIReadyResponse
+}
+
+// Health checks that the database is reachable
+func (app *App) Health() error {
+	ctx, cancel := context.WithTimeout(context.Background(), PROBE_TIMEOUT)
+	defer cancel()
+	if err := app.Db.PingContext(ctx); err != nil {
+		return errors.New("database not reachable:" + err.Error())
+	}
+	return nil
+}
+
+// Readiness reports whether the service can answer queries: the database is
+// reachable, at least one rpc answers and the indexed block lags at most
+// MaxLagBlocks blocks behind the chain head. The probes run without holding
+// the cached status, while they run other callers get the previous status.
+func (app *App) Readiness() utils.APIReadyResponse {
+	app.ready.mu.Lock()
+	status, checked := app.ready.status, app.ready.checked
+	app.ready.mu.Unlock()
+	if time.Since(checked) < READY_CACHE {
+		return status
+	}
+	if !app.ready.probing.TryLock() {
+		if !checked.IsZero() {
+			return status
+		}
+		// no previous status, wait for the running probes
+		app.ready.probing.Lock()
+	}
+	defer app.ready.probing.Unlock()
+	app.ready.mu.Lock()
+	status, checked = app.ready.status, app.ready.checked
+	app.ready.mu.Unlock()
+	if time.Since(checked) < READY_CACHE {
+		// probed by another caller meanwhile
+		return status
+	}
+	status = app.probeReadiness()
+	app.ready.mu.Lock()
+	app.ready.status = status
+	app.ready.checked = time.Now()
+	app.ready.mu.Unlock()
+	return status
+}
+
+// probeReadiness runs the readiness probes
+func (app *App) probeReadiness() utils.APIReadyResponse {
+	status := utils.APIReadyResponse{MaxLag: app.Config.MaxLagBlocks}
+	if err := app.Health(); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	head, err := app.RpcMngr.HeadBlock(PROBE_TIMEOUT)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.ChainHead = head
+	status.IndexedBlock = app.DBGetLatestBlock()
+	if head > status.IndexedBlock {
+		status.Lag = head - status.IndexedBlock
+	}
+	if status.Lag > app.Config.MaxLagBlocks {
+		status.Error = fmt.Sprintf("indexer %d blocks behind chain head", status.Lag)
+		return status
+	}
+	status.Ready = true
+	return status
+}
@@ -0,0 +1,101 @@
+package etherfi
+
+import (
+	"fmt"
+	"log/slog"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/D8-X/d8x-etherfi/internal/metrics"
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+)
+
+// latestBalances holds the precomputed balances of the entire holder
+// universe at the latest indexed block
+type latestBalances struct {
+	mu         sync.RWMutex
+	running    sync.Mutex
+	block      uint64
+	balances   map[string]utils.Balance
+	computedAt time.Time
+}
+
+// RefreshLatestBalances recomputes the balances of the holder universe at the latest
+// indexed block if at least PrecomputeBlocks blocks passed since the last computation.
+// Does nothing if a computation is already running.
+func (app *App) RefreshLatestBalances() {
+	if app.Config.PrecomputeBlocks < 0 {
+		return
+	}
+	if !app.latest.running.TryLock() {
+		return
+	}
+	defer app.latest.running.Unlock()
+	block := app.DBGetLatestBlock()
+	app.latest.mu.RLock()
+	last := app.latest.block
+	app.latest.mu.RUnlock()
+	if block <= last || (last > 0 && block < last+uint64(app.Config.PrecomputeBlocks)) {
+		return
+	}
+	time0 := time.Now()
+	balances := make(map[string]utils.Balance)
+	// the precomputation is not subject to admission control, it runs
+	// at most once at a time
+	err := app.streamBalances(utils.APIBalancesPayload{BlockNumber: block}, func(b utils.Balance) error {
+		balances[b.Address] = b
+		return nil
+	})
+	if err != nil {
+		slog.Error(fmt.Sprintf("precomputing balances for block %d failed: %s", block, err.Error()))
+		return
+	}
+	app.latest.mu.Lock()
+	app.latest.block = block
+	app.latest.balances = balances
+	app.latest.computedAt = time.Now()
+	app.latest.mu.Unlock()
+	metrics.Holders.Set(float64(len(balances)))
+	slog.Info(fmt.Sprintf("precomputed %d balances for block %d in %s", len(balances), block, time.Since(time0)))
+}
+
+// LatestBalancesBlock returns the block of the precomputed balances, 0
+// if not available
+func (app *App) LatestBalancesBlock() uint64 {
+	app.latest.mu.RLock()
+	defer app.latest.mu.RUnlock()
+	return app.latest.block
+}
+
+// latestBalancesFor returns the precomputed balances if they are available for the
+// requested block. For explicit addresses, addresses without balance are reported with zero.
+func (app *App) latestBalancesFor(req utils.APIBalancesPayload) (utils.APIBalancesResponse, bool) {
+	app.latest.mu.RLock()
+	defer app.latest.mu.RUnlock()
+	if app.latest.block == 0 || app.latest.block != req.BlockNumber {
+		return utils.APIBalancesResponse{}, false
+	}
+	var r utils.APIBalancesResponse
+	if len(req.Addresses) == 0 {
+		r.Result = make([]utils.Balance, 0, len(app.latest.balances))
+		for _, b := range app.latest.balances {
+			r.Result = append(r.Result, b)
+		}
+	} else {
+		r.Result = make([]utils.Balance, 0, len(req.Addresses))
+		for _, a := range req.Addresses {
+			b, exists := app.latest.balances[a]
+			if !exists {
+				b = utils.Balance{Address: a, EffBalance: 0, Amount: new(big.Int)}
+			}
+			r.Result = append(r.Result, b)
+		}
+	}
+	r.Precomputed = &utils.Precomputed{
+		BlockNumber: app.latest.block,
+		ComputedAt:  app.latest.computedAt.Unix(),
+		AgeSec:      time.Since(app.latest.computedAt).Seconds(),
+	}
+	return r, true
+}
@@ -0,0 +1,224 @@
+package etherfi
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/D8-X/d8x-etherfi/internal/filterer"
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+)
+
+const (
+	EVENT_TRADE       = "trade"
+	EVENT_DEPOSIT     = "deposit"
+	EVENT_WITHDRAW    = "withdrawal"
+	EVENT_LIQUIDATION = "liquidation"
+	EVENT_SETTLEMENT  = "settlement"
+	TABLE_TRADE       = "perp_trade"
+	TABLE_MARGIN      = "perp_margin"
+	TABLE_LIQUIDATION = "perp_liquidation"
+	// default and maximal number of events per history page
+	HISTORY_LIMIT     = 100
+	HISTORY_MAX_LIMIT = 1000
+)
+
+// perpEvents are the event types of the trader history
+var perpEvents = []string{EVENT_TRADE, EVENT_DEPOSIT, EVENT_WITHDRAW, EVENT_LIQUIDATION, EVENT_SETTLEMENT}
+
+// ErrInvalidHistoryCursor is returned for a malformed history cursor
+var ErrInvalidHistoryCursor = errors.New("invalid cursor")
+
+// poolScope selects the rows of the chain and pool
+func poolScope(app *App) (string, []any) {
+	return "chain_id=$1 AND pool_id=$2", []any{app.Sdk.ChainConfig.ChainId, app.PoolId}
+}
+
+// marginScope selects the rows of the margin event kind of the chain and pool, the
+// deposits, withdrawals and settlements share one table
+func marginScope(kind string) func(app *App) (string, []any) {
+	return func(app *App) (string, []any) {
+		return "chain_id=$1 AND pool_id=$2 AND kind=$3", []any{app.Sdk.ChainConfig.ChainId, app.PoolId, kind}
+	}
+}
+
+// dbInsertTradeRows inserts trades into the given trade table
+func (app *App) dbInsertTradeRows(tx *sql.Tx, table string, trades []filterer.Trade, toBlock uint64) error {
+	stmt, err := tx.Prepare(`INSERT INTO ` + table + `(chain_id, pool_id, perpetual_id, trader, amount_bc, price,
+		new_position_bc, fee_cc, pnl_cc, order_digest, block, tx_hash, log_index, to_block)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	chainId := app.Sdk.ChainConfig.ChainId
+	for _, t := range trades {
+		_, err := stmt.Exec(chainId, app.PoolId, t.PerpetualId, t.Trader, t.AmountBC, t.Price,
+			t.NewPositionBC, t.FeeCC, t.PnlCC, t.OrderDigest, t.BlockNr, t.TxHash, t.LogIndex, toBlock)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// marginInsert returns the insert function of the margin event kind
+func marginInsert(kind string) func(app *App, tx *sql.Tx, table string, rows []filterer.MarginChange, toBlock uint64) error {
+	return func(app *App, tx *sql.Tx, table string, rows []filterer.MarginChange, toBlock uint64) error {
+		stmt, err := tx.Prepare(`INSERT INTO ` + table + `(chain_id, pool_id, perpetual_id, trader, kind, amount_cc,
+			block, tx_hash, log_index, to_block) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			ON CONFLICT DO NOTHING`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		chainId := app.Sdk.ChainConfig.ChainId
+		for _, m := range rows {
+			_, err := stmt.Exec(chainId, app.PoolId, m.PerpetualId, m.Trader, kind, m.AmountCC,
+				m.BlockNr, m.TxHash, m.LogIndex, toBlock)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// dbInsertLiquidationRows inserts liquidations into the given liquidation table
+func (app *App) dbInsertLiquidationRows(tx *sql.Tx, table string, liquidations []filterer.Liquidation, toBlock uint64) error {
+	stmt, err := tx.Prepare(`INSERT INTO ` + table + `(chain_id, pool_id, perpetual_id, trader, liquidator, amount_bc,
+		price, new_position_bc, fee_cc, pnl_cc, block, tx_hash, log_index, to_block)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	chainId := app.Sdk.ChainConfig.ChainId
+	for _, l := range liquidations {
+		_, err := stmt.Exec(chainId, app.PoolId, l.PerpetualId, l.Trader, l.Liquidator, l.AmountBC,
+			l.Price, l.NewPositionBC, l.FeeCC, l.PnlCC, l.BlockNr, l.TxHash, l.LogIndex, toBlock)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TraderHistory returns the perpetual events of the trader in the blocks [fromBlock, toBlock]
+// (toBlock 0 for all indexed blocks) in block order, at most limit events after the cursor
+// of the previous page. The next cursor is empty on the last page.
+func (app *App) TraderHistory(addr string, fromBlock, toBlock uint64, limit int, cursor string) (utils.APIHistoryResponse, error) {
+	res := utils.APIHistoryResponse{Address: strings.ToLower(addr), Events: []utils.PerpEvent{}}
+	res.IndexedBlock = app.perpIndexedBlock()
+	if toBlock == 0 || toBlock > res.IndexedBlock {
+		toBlock = res.IndexedBlock
+	}
+	res.Gaps = app.perpGaps(fromBlock, toBlock)
+	var afterBlock uint64
+	afterLog := -1
+	if cursor != "" {
+		var err error
+		afterBlock, afterLog, err = decodeHistoryCursor(cursor)
+		if err != nil {
+			return res, err
+		}
+	}
+	if limit <= 0 {
+		limit = HISTORY_LIMIT
+	}
+	limit = min(limit, HISTORY_MAX_LIMIT)
+	query := `SELECT event, perpetual_id, block, tx_hash, log_index, amount, price, new_position_bc, fee_cc, pnl_cc, liquidator, order_digest FROM (
+		SELECT '` + EVENT_TRADE + `' AS event, perpetual_id, block, tx_hash, log_index, amount_bc AS amount, price,
+			new_position_bc, fee_cc, pnl_cc, NULL AS liquidator, order_digest
+			FROM ` + TABLE_TRADE + ` WHERE chain_id=$1 AND pool_id=$2 AND trader=$3
+		UNION ALL
+		SELECT kind, perpetual_id, block, tx_hash, log_index, amount_cc, NULL, NULL, NULL, NULL, NULL, NULL
+			FROM ` + TABLE_MARGIN + ` WHERE chain_id=$1 AND pool_id=$2 AND trader=$3
+		UNION ALL
+		SELECT '` + EVENT_LIQUIDATION + `', perpetual_id, block, tx_hash, log_index, amount_bc, price,
+			new_position_bc, fee_cc, pnl_cc, liquidator, NULL
+			FROM ` + TABLE_LIQUIDATION + ` WHERE chain_id=$1 AND pool_id=$2 AND trader=$3
+	) events WHERE block BETWEEN $4 AND $5 AND (block, log_index) > ($6, $7)
+	ORDER BY block, log_index LIMIT $8`
+	rows, err := app.Db.Query(query, app.Sdk.ChainConfig.ChainId, app.PoolId, res.Address,
+		fromBlock, toBlock, afterBlock, afterLog, limit+1)
+	if err != nil {
+		return res, errors.New("TraderHistory:" + err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e utils.PerpEvent
+		var liquidator, digest sql.NullString
+		err := rows.Scan(&e.Event, &e.PerpetualId, &e.BlockNumber, &e.TxHash, &e.LogIndex, &e.Amount,
+			&e.Price, &e.NewPositionBC, &e.FeeCC, &e.PnlCC, &liquidator, &digest)
+		if err != nil {
+			return res, errors.New("TraderHistory:" + err.Error())
+		}
+		e.Liquidator, e.OrderDigest = liquidator.String, digest.String
+		res.Events = append(res.Events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return res, errors.New("TraderHistory:" + err.Error())
+	}
+	if len(res.Events) > limit {
+		res.Events = res.Events[:limit]
+		last := res.Events[limit-1]
+		res.NextCursor = encodeHistoryCursor(last.BlockNumber, last.LogIndex)
+	}
+	return res, nil
+}
+
+// perpGaps returns the blocks in [fromBlock, toBlock] for which any perpetual event
+// type is not indexed, according to the cached range checks
+func (app *App) perpGaps(fromBlock, toBlock uint64) []utils.BlockRange {
+	gaps := make([]utils.BlockRange, 0)
+	if fromBlock > toBlock {
+		return gaps
+	}
+	var missing []utils.BlockRange
+	for _, check := range app.RangeChecks() {
+		if slices.Contains(perpEvents, check.Event) {
+			missing = append(missing, check.Gaps...)
+		}
+	}
+	return append(gaps, intersectRanges(utils.BlockRange{From: fromBlock, To: toBlock}, mergeRanges(missing))...)
+}
+
+// perpIndexedBlock returns the block up to which all perpetual events are indexed
+func (app *App) perpIndexedBlock() uint64 {
+	var indexed uint64
+	for k, event := range perpEvents {
+		block := app.DbGetIndexedBlock(event)
+		if k == 0 || block < indexed {
+			indexed = block
+		}
+	}
+	return indexed
+}
+
+// encodeHistoryCursor returns the cursor of the page after the event
+func encodeHistoryCursor(block uint64, logIndex int) string {
+	return fmt.Sprintf("%d-%d", block, logIndex)
+}
+
+// decodeHistoryCursor returns the block and log index of the cursor
+func decodeHistoryCursor(cursor string) (uint64, int, error) {
+	blockStr, logStr, found := strings.Cut(cursor, "-")
+	if !found {
+		return 0, 0, ErrInvalidHistoryCursor
+	}
+	block, err := strconv.ParseUint(blockStr, 10, 64)
+	if err != nil {
+		return 0, 0, ErrInvalidHistoryCursor
+	}
+	logIndex, err := strconv.Atoi(logStr)
+	if err != nil || logIndex < 0 {
+		return 0, 0, ErrInvalidHistoryCursor
+	}
+	return block, logIndex, nil
+}
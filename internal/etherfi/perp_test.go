@@ -0,0 +1,15 @@
+package etherfi
+
+import "testing"
+
+func TestHistoryCursor(t *testing.T) {
+	block, logIndex, err := decodeHistoryCursor(encodeHistoryCursor(123456, 7))
+	if err != nil || block != 123456 || logIndex != 7 {
+		t.Fatalf("unexpected cursor %d-%d: %v", block, logIndex, err)
+	}
+	for _, cursor := range []string{"123456", "x-1", "1--1", "1-"} {
+		if _, _, err := decodeHistoryCursor(cursor); err != ErrInvalidHistoryCursor {
+			t.Fatalf("cursor %s accepted", cursor)
+		}
+	}
+}
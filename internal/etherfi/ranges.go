@@ -0,0 +1,241 @@
+package etherfi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/D8-X/d8x-etherfi/internal/filterer"
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+)
+
+const (
+	// sources of indexed ranges
+	RANGE_INDEXER  = "indexer"
+	RANGE_LEGACY   = "legacy" // indexed before ranges were recorded
+	RANGE_BACKFILL = "backfill"
+	RANGE_REPAIR   = "repair"
+	// the status endpoint reports range checks that are at most RANGE_CHECK_TTL old
+	RANGE_CHECK_TTL = 5 * time.Minute
+)
+
+// indexedRange is a block range for which the events were stored
+type indexedRange struct {
+	id     int64
+	rng    utils.BlockRange
+	source string
+}
+
+// replaces is true for ranges whose events replaced the stored events of the range,
+// they fix overlaps of earlier ranges
+func (r indexedRange) replaces() bool {
+	return r.source == RANGE_BACKFILL || r.source == RANGE_REPAIR
+}
+
+// rangeChecks caches the last range checks for the status endpoint
+type rangeChecks struct {
+	mu        sync.Mutex
+	checkedOn time.Time
+	last      []utils.RangeCheck
+}
+
+// RangeChecks returns the range checks of all event types, recomputed
+// if older than RANGE_CHECK_TTL
+func (app *App) RangeChecks() []utils.RangeCheck {
+	app.rangeChecks.mu.Lock()
+	defer app.rangeChecks.mu.Unlock()
+	if time.Since(app.rangeChecks.checkedOn) < RANGE_CHECK_TTL {
+		return app.rangeChecks.last
+	}
+	checks := make([]utils.RangeCheck, 0, len(indexedEvents))
+	for _, h := range indexedEvents {
+		check, err := app.CheckRanges(h.event())
+		if err != nil {
+			slog.Error(err.Error())
+			return app.rangeChecks.last
+		}
+		checks = append(checks, check)
+	}
+	app.rangeChecks.last = checks
+	app.rangeChecks.checkedOn = time.Now()
+	return checks
+}
+
+// CheckRanges finds the gaps and overlaps in the indexed ranges of the event type,
+// from the genesis block up to the indexed block
+func (app *App) CheckRanges(event string) (utils.RangeCheck, error) {
+	indexed, err := app.dbGetIndexedBlock(event)
+	if err != nil {
+		return utils.RangeCheck{}, errors.New("CheckRanges:" + err.Error())
+	}
+	ranges, err := app.dbGetIndexedRanges(event)
+	if err != nil {
+		return utils.RangeCheck{}, errors.New("CheckRanges:" + err.Error())
+	}
+	check := utils.RangeCheck{
+		Event:     event,
+		CheckedOn: time.Now(),
+		From:      app.Genesis + 1,
+		To:        indexed,
+	}
+	check.Gaps, check.Overlaps = checkRanges(ranges, check.From, check.To)
+	return check, nil
+}
+
+// RepairRanges re-indexes the gaps and overlaps of the check, at most maxBlocks
+// blocks (0 for all). Returns the number of re-indexed blocks.
+func (app *App) RepairRanges(ctx context.Context, check utils.RangeCheck, maxBlocks int) (int, error) {
+	k := eventIdx(check.Event)
+	if k < 0 {
+		return 0, errors.New("RepairRanges: unknown event type " + check.Event)
+	}
+	h := indexedEvents[k]
+	var repaired int
+	for _, rng := range mergeRanges(append(slices.Clone(check.Gaps), check.Overlaps...)) {
+		for from := rng.From; from <= rng.To; from += filterer.PARALLEL_CHUNK {
+			to := min(from+filterer.PARALLEL_CHUNK-1, rng.To)
+			if maxBlocks > 0 {
+				if repaired >= maxBlocks {
+					return repaired, nil
+				}
+				to = min(to, from+uint64(maxBlocks-repaired)-1)
+			}
+			events, _, err := app.Filterer.FilterEvents(ctx, []filterer.EventType{h.eventType()}, from, to)
+			if err != nil {
+				return repaired, fmt.Errorf("RepairRanges:%w", err)
+			}
+			n, err := app.dbReplaceRange(h.table(), check.Event, from, to, events, RANGE_REPAIR, nil)
+			if err != nil {
+				return repaired, errors.New("RepairRanges:" + err.Error())
+			}
+			slog.Info(fmt.Sprintf("repaired %s blocks %d-%d: %d events", check.Event, from, to, n))
+			repaired += int(to - from + 1)
+		}
+	}
+	return repaired, nil
+}
+
+// repairRanges is run by the indexer after each filter cycle and re-indexes
+// up to Config.RepairBlocks blocks per event type
+func (app *App) repairRanges(ctx context.Context) {
+	if app.Config.RepairBlocks < 0 {
+		return
+	}
+	for _, h := range indexedEvents {
+		event := h.event()
+		check, err := app.CheckRanges(event)
+		if err != nil {
+			slog.Error(err.Error())
+			continue
+		}
+		if len(check.Gaps) == 0 && len(check.Overlaps) == 0 {
+			continue
+		}
+		slog.Info(fmt.Sprintf("%s ranges: %d gaps, %d overlaps", event, len(check.Gaps), len(check.Overlaps)))
+		if _, err := app.RepairRanges(ctx, check, app.Config.RepairBlocks); err != nil {
+			slog.Error(err.Error())
+		}
+	}
+	// report the repaired state
+	app.rangeChecks.mu.Lock()
+	app.rangeChecks.checkedOn = time.Time{}
+	app.rangeChecks.mu.Unlock()
+}
+
+// checkRanges returns the blocks in [from, to] not covered by any range and the blocks
+// covered by more than one appending range, unless a later range replaced them
+func checkRanges(ranges []indexedRange, from, to uint64) ([]utils.BlockRange, []utils.BlockRange) {
+	ranges = slices.Clone(ranges)
+	slices.SortFunc(ranges, func(a, b indexedRange) int { return int(a.id - b.id) })
+	all := make([]utils.BlockRange, 0, len(ranges))
+	for _, r := range ranges {
+		all = append(all, r.rng)
+	}
+	gaps := []utils.BlockRange{}
+	if to >= from {
+		gaps = subtractRanges([]utils.BlockRange{{From: from, To: to}}, mergeRanges(all))
+	}
+	overlaps := []utils.BlockRange{}
+	var appended []utils.BlockRange
+	for k, r := range ranges {
+		if r.replaces() {
+			continue
+		}
+		ov := intersectRanges(r.rng, appended)
+		if len(ov) > 0 {
+			var later []utils.BlockRange
+			for _, l := range ranges[k+1:] {
+				if l.replaces() {
+					later = append(later, l.rng)
+				}
+			}
+			overlaps = append(overlaps, subtractRanges(ov, mergeRanges(later))...)
+		}
+		appended = mergeRanges(append(appended, r.rng))
+	}
+	return gaps, mergeRanges(overlaps)
+}
+
+// mergeRanges returns the union of the ranges as sorted disjoint ranges
+func mergeRanges(ranges []utils.BlockRange) []utils.BlockRange {
+	sorted := slices.Clone(ranges)
+	slices.SortFunc(sorted, func(a, b utils.BlockRange) int {
+		if a.From < b.From {
+			return -1
+		}
+		if a.From > b.From {
+			return 1
+		}
+		return 0
+	})
+	merged := make([]utils.BlockRange, 0, len(sorted))
+	for _, r := range sorted {
+		if n := len(merged); n > 0 && r.From <= merged[n-1].To+1 {
+			merged[n-1].To = max(merged[n-1].To, r.To)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// subtractRanges returns the blocks of the ranges a that are not in the sorted disjoint ranges b
+func subtractRanges(a, b []utils.BlockRange) []utils.BlockRange {
+	rest := make([]utils.BlockRange, 0)
+	for _, r := range a {
+		cur, done := r.From, false
+		for _, s := range b {
+			if done || s.To < cur || s.From > r.To {
+				continue
+			}
+			if s.From > cur {
+				rest = append(rest, utils.BlockRange{From: cur, To: s.From - 1})
+			}
+			if s.To >= r.To {
+				done = true
+				continue
+			}
+			cur = s.To + 1
+		}
+		if !done {
+			rest = append(rest, utils.BlockRange{From: cur, To: r.To})
+		}
+	}
+	return rest
+}
+
+// intersectRanges returns the blocks of r that are in the ranges b
+func intersectRanges(r utils.BlockRange, b []utils.BlockRange) []utils.BlockRange {
+	var common []utils.BlockRange
+	for _, s := range b {
+		lo, hi := max(r.From, s.From), min(r.To, s.To)
+		if lo <= hi {
+			common = append(common, utils.BlockRange{From: lo, To: hi})
+		}
+	}
+	return common
+}
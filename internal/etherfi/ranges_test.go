@@ -0,0 +1,43 @@
+package etherfi
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+)
+
+func TestCheckRanges(t *testing.T) {
+	ranges := []indexedRange{
+		{id: 1, rng: utils.BlockRange{From: 0, To: 100}, source: RANGE_LEGACY},
+		{id: 2, rng: utils.BlockRange{From: 101, To: 200}, source: RANGE_INDEXER},
+		// skipped 201-250
+		{id: 3, rng: utils.BlockRange{From: 251, To: 400}, source: RANGE_INDEXER},
+		// indexed twice
+		{id: 4, rng: utils.BlockRange{From: 350, To: 500}, source: RANGE_INDEXER},
+		{id: 5, rng: utils.BlockRange{From: 450, To: 600}, source: RANGE_INDEXER},
+		// repaired overlap 450-500
+		{id: 6, rng: utils.BlockRange{From: 450, To: 500}, source: RANGE_REPAIR},
+	}
+	gaps, overlaps := checkRanges(ranges, 11, 700)
+	expGaps := []utils.BlockRange{{From: 201, To: 250}, {From: 601, To: 700}}
+	if !reflect.DeepEqual(gaps, expGaps) {
+		t.Fatalf("unexpected gaps %v", gaps)
+	}
+	expOverlaps := []utils.BlockRange{{From: 350, To: 400}}
+	if !reflect.DeepEqual(overlaps, expOverlaps) {
+		t.Fatalf("unexpected overlaps %v", overlaps)
+	}
+}
+
+func TestCheckRangesComplete(t *testing.T) {
+	ranges := []indexedRange{
+		{id: 1, rng: utils.BlockRange{From: 11, To: 500}, source: RANGE_INDEXER},
+		// backfill replaces the events of indexed blocks
+		{id: 2, rng: utils.BlockRange{From: 100, To: 200}, source: RANGE_BACKFILL},
+	}
+	gaps, overlaps := checkRanges(ranges, 11, 500)
+	if len(gaps) != 0 || len(overlaps) != 0 {
+		t.Fatalf("unexpected gaps %v or overlaps %v", gaps, overlaps)
+	}
+}
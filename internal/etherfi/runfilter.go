@@ -1,51 +1,338 @@
 package etherfi
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"sync"
 	"time"
+
+	"github.com/D8-X/d8x-etherfi/internal/filterer"
+	"github.com/D8-X/d8x-etherfi/internal/metrics"
+	"github.com/D8-X/d8x-etherfi/internal/utils"
 )
 
-func (app *App) RunFilter() {
-	var wg sync.WaitGroup
-	wg.Add(2)
-	slog.Info("Filter for events")
+const (
+	EVENT_DELEGATE = "delegate"
+	EVENT_TRANSFER = "transfer"
+	TABLE_DELEGATE = "delegates"
+	TABLE_TRANSFER = "sh_tkn_transfer"
+	// pause between two event filter cycles
+	FILTER_INTERVAL = 2 * time.Minute
+	// API replicas without indexer check for newly indexed blocks every FOLLOW_INTERVAL
+	FOLLOW_INTERVAL = 15 * time.Second
+	// pause before a failed websocket subscription is renewed
+	WS_RECONNECT = 10 * time.Second
+	// event types starting more than LAGGING_BLOCKS behind the most advanced event
+	// type are caught up in a separate pass, so that they do not hold back the others
+	LAGGING_BLOCKS = filterer.PARALLEL_CHUNK
+	// lagging event types advance by at most CATCH_UP_BLOCKS per cycle
+	CATCH_UP_BLOCKS = 20 * filterer.PARALLEL_CHUNK
+)
+
+// filterRuns keeps the result of the last event filter cycle of this instance,
+// the last cycle of the indexer is stored in table filter_run
+type filterRuns struct {
+	mu   sync.Mutex
+	last *utils.FilterRun
+}
+
+// RunIndexer runs the event filterer. With leader election, only the leader
+// filters and the other instances follow the index until they take over.
+func (app *App) RunIndexer(ctx context.Context) {
+	if app.Leader == nil {
+		app.RunFilter(ctx)
+		return
+	}
+	app.background.Add(1)
 	go func() {
-		defer wg.Done()
-		delegateBlock := app.DbGetDelegateStartBlock() + 1
-		delegates, upToBlockD, err := app.Filterer.FilterDelegateEvts(delegateBlock, 0)
-		if err != nil {
-			slog.Error(err.Error())
+		defer app.background.Done()
+		app.FollowIndex(ctx)
+	}()
+	app.Leader.Run(ctx, app.RunFilter)
+}
+
+// RunFilter periodically filters for new events until ctx is canceled. With a
+// websocket rpc, events are streamed instead.
+func (app *App) RunFilter(ctx context.Context) {
+	// continue where the previous leader stopped
+	if err := app.DBReloadIndexedBlocks(); err != nil {
+		slog.Error(err.Error())
+	}
+	if app.Config.RpcUrlWs != "" {
+		app.runSubscription(ctx)
+		return
+	}
+	for {
+		app.runFilterCycle(ctx)
+		select {
+		case <-ctx.Done():
+			slog.Info("Event filterer stopped")
 			return
+		case <-time.After(FILTER_INTERVAL):
 		}
-		msg := fmt.Sprintf("FilterDelegateEvts found %d delegation events", len(delegates))
-		slog.Info(msg)
-		err = app.DBInsertDelegates(delegates, upToBlockD)
-		if err != nil {
+	}
+}
+
+// FollowIndex is the counterpart of RunFilter for API replicas that do not index:
+// it periodically reads the indexed blocks from the database and precomputes the
+// latest balances, until ctx is canceled
+func (app *App) FollowIndex(ctx context.Context) {
+	for {
+		if app.Leader != nil && app.Leader.IsLeader() {
+			// the leader updates the indexed blocks itself
+		} else if err := app.DBReloadIndexedBlocks(); err != nil {
 			slog.Error(err.Error())
+		} else {
+			for k, h := range indexedEvents {
+				metrics.IndexedBlock.WithLabelValues(h.event()).Set(float64(app.LastBlockTo[k].Load()))
+			}
+			app.background.Add(1)
+			go func() {
+				defer app.background.Done()
+				app.RefreshLatestBalances()
+			}()
 		}
-		app.LastBlockTo[0] = upToBlockD
-	}()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(FOLLOW_INTERVAL):
+		}
+	}
+}
 
+// runFilterCycle filters and stores the events since the last cycle. If ctx
+// is canceled, the events of the completed chunks are stored.
+func (app *App) runFilterCycle(ctx context.Context) {
+	slog.Info("Filter for events")
+	run := utils.FilterRun{
+		StartedOn: time.Now(),
+		Errors:    make(map[string]string),
+	}
+	var err error
+	run.Events, err = app.filterAndStore(ctx)
+	if err != nil {
+		for _, h := range indexedEvents {
+			run.Errors[h.event()] = err.Error()
+		}
+	}
+	run.FinishedOn = time.Now()
+	run.Ok = len(run.Errors) == 0
+	app.recordFilterRun(run)
+	slog.Info("Event filterer completed")
+	if ctx.Err() != nil {
+		return
+	}
+	app.repairRanges(ctx)
+	app.background.Add(1)
 	go func() {
-		defer wg.Done()
-		transferBlock := app.DbGetShTknTransferStartBlock() + 1
-		transfers, upToBlockT, err := app.Filterer.FilterTransferEvts(transferBlock, 0)
-		if err != nil {
-			slog.Error(err.Error())
+		defer app.background.Done()
+		app.RefreshLatestBalances()
+	}()
+}
+
+// runSubscription streams events over the websocket rpc until ctx is canceled. Before
+// each (re-)subscription a polling cycle fills the gap since the last stored block.
+func (app *App) runSubscription(ctx context.Context) {
+	for {
+		app.runFilterCycle(ctx)
+		err := app.streamEvents(ctx)
+		if ctx.Err() != nil {
+			slog.Info("Event subscription stopped")
 			return
 		}
-		msg := fmt.Sprintf("FilterTransferEvts found %d transfer events", len(transfers))
-		slog.Info(msg)
-		err = app.DBInsertShTknTransfer(transfers, upToBlockT)
-		if err != nil {
+		slog.Error("event subscription failed, resubscribing:" + err.Error())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(WS_RECONNECT):
+		}
+	}
+}
+
+// streamEvents stores the events of the websocket subscription as they arrive. Every
+// FILTER_INTERVAL, lagging event types are caught up, the ranges are repaired, the filter
+// run is reported and the latest balances are precomputed.
+func (app *App) streamEvents(ctx context.Context) error {
+	starts, _ := app.eventStarts()
+	run := utils.FilterRun{StartedOn: time.Now(), Errors: make(map[string]string), Events: newEventCounts()}
+	store := app.eventStore(starts, run.Events)
+	handle := func(events filterer.Events, from, to uint64) error {
+		if err := store(events, from, to); err != nil {
+			return err
+		}
+		if time.Since(run.StartedOn) < FILTER_INTERVAL {
+			return nil
+		}
+		run.FinishedOn = time.Now()
+		run.Ok = true
+		app.recordFilterRun(run)
+		run = utils.FilterRun{StartedOn: time.Now(), Errors: make(map[string]string), Events: newEventCounts()}
+		store = app.eventStore(starts, run.Events)
+		if err := app.catchUp(ctx, run.Events); err != nil && !errors.Is(err, context.Canceled) {
 			slog.Error(err.Error())
 		}
-		app.LastBlockTo[1] = upToBlockT
-	}()
-	wg.Wait()
-	slog.Info("Event filterer completed")
-	// Schedule the next call of Scan in 2 minutes
-	time.AfterFunc(2*time.Minute, app.RunFilter)
+		app.repairRanges(ctx)
+		app.background.Add(1)
+		go func() {
+			defer app.background.Done()
+			app.RefreshLatestBalances()
+		}()
+		return nil
+	}
+	_, err := app.Filterer.Subscribe(ctx, app.Config.RpcUrlWs, eventTypesOf(starts), lowestStart(starts), app.Config.FilterWorkers, handle)
+	return err
+}
+
+// filterAndStore filters the events of all types since the lowest indexed block with one log
+// query per window, and stores them chunk by chunk, each chunk in one transaction. Lagging event
+// types are caught up in a separate pass. Returns the number of stored events per event type.
+// If ctx is canceled, the chunks completed so far are stored.
+func (app *App) filterAndStore(ctx context.Context) (map[string]int, error) {
+	starts, _ := app.eventStarts()
+	counts := newEventCounts()
+	_, err := app.Filterer.FilterEventsParallel(ctx, eventTypesOf(starts), lowestStart(starts), 0, app.Config.FilterWorkers, app.eventStore(starts, counts))
+	if err == nil {
+		err = app.catchUp(ctx, counts)
+	}
+	if err != nil && !errors.Is(err, context.Canceled) {
+		slog.Error(err.Error())
+		return counts, err
+	}
+	slog.Info(fmt.Sprintf("Filterer stored %d delegation and %d transfer events", counts[EVENT_DELEGATE], counts[EVENT_TRANSFER]))
+	return counts, nil
+}
+
+// catchUp filters the events of the lagging event types for up to CATCH_UP_BLOCKS blocks
+func (app *App) catchUp(ctx context.Context, counts map[string]int) error {
+	_, lagging := app.eventStarts()
+	if len(lagging) == 0 {
+		return nil
+	}
+	from := lowestStart(lagging)
+	to := from + CATCH_UP_BLOCKS - 1
+	slog.Info(fmt.Sprintf("Catching up %v from block %d to %d", eventTypesOf(lagging), from, to))
+	_, err := app.Filterer.FilterEventsParallel(ctx, eventTypesOf(lagging), from, to, app.Config.FilterWorkers, app.eventStore(lagging, counts))
+	return err
+}
+
+// eventStarts returns the first block to index per event type, split into the event
+// types that are up to date and the lagging ones
+func (app *App) eventStarts() (map[string]uint64, map[string]uint64) {
+	starts := make(map[string]uint64, len(indexedEvents))
+	for _, h := range indexedEvents {
+		starts[h.event()] = app.DbGetIndexedBlock(h.event()) + 1
+	}
+	return splitStarts(starts)
+}
+
+// splitStarts splits the start blocks into the event types starting at most LAGGING_BLOCKS
+// behind the most advanced event type and the lagging event types
+func splitStarts(starts map[string]uint64) (map[string]uint64, map[string]uint64) {
+	var highest uint64
+	for _, start := range starts {
+		highest = max(highest, start)
+	}
+	current := make(map[string]uint64, len(starts))
+	lagging := make(map[string]uint64)
+	for event, start := range starts {
+		if start+LAGGING_BLOCKS < highest {
+			lagging[event] = start
+		} else {
+			current[event] = start
+		}
+	}
+	return current, lagging
+}
+
+// lowestStart returns the lowest start block
+func lowestStart(starts map[string]uint64) uint64 {
+	var lowest uint64
+	for _, start := range starts {
+		if lowest == 0 || start < lowest {
+			lowest = start
+		}
+	}
+	return lowest
+}
+
+// newEventCounts returns zero counts for all event types
+func newEventCounts() map[string]int {
+	counts := make(map[string]int, len(indexedEvents))
+	for _, h := range indexedEvents {
+		counts[h.event()] = 0
+	}
+	return counts
+}
+
+// eventStore returns a chunk handler that stores the events of a chunk and adds
+// the number of stored events per event type to counts
+func (app *App) eventStore(starts map[string]uint64, counts map[string]int) filterer.ChunkHandler {
+	return func(events filterer.Events, from, to uint64) error {
+		stored, err := app.DBInsertEvents(events, starts, from, to)
+		if err != nil {
+			return err
+		}
+		for event, n := range stored {
+			counts[event] += n
+			app.LastBlockTo[eventIdx(event)].Store(to)
+			metrics.EventsIngested.WithLabelValues(event).Add(float64(n))
+			metrics.IndexedBlock.WithLabelValues(event).Set(float64(to))
+		}
+		return nil
+	}
+}
+
+// Status returns the configuration of the service and up to which
+// block events are indexed
+func (app *App) Status() utils.APIStatusResponse {
+	ready := app.Readiness()
+	s := utils.APIStatusResponse{
+		ChainId:           app.Config.ChainId,
+		PoolId:            app.Config.PoolId,
+		PoolTokenAddr:     app.PoolTknAddr.Hex(),
+		PoolTokenDecimals: app.PoolTknDecimals,
+		ShareTokenAddr:    app.PoolShareTknAddr.Hex(),
+		GenesisBlock:      app.Genesis,
+		IndexedBlocks:     make(map[string]uint64, len(indexedEvents)),
+		IndexedBlock:      app.DBGetLatestBlock(),
+		ChainHead:         ready.ChainHead,
+		Version:           utils.BuildVersion,
+		Leader:            app.Leader != nil && app.Leader.IsLeader(),
+		RangeChecks:       app.RangeChecks(),
+	}
+	for _, h := range indexedEvents {
+		s.IndexedBlocks[h.event()] = app.DbGetIndexedBlock(h.event())
+	}
+	if s.ChainHead > s.IndexedBlock {
+		s.Lag = s.ChainHead - s.IndexedBlock
+	}
+	s.LastFilterRun = app.lastFilterRun()
+	return s
+}
+
+// recordFilterRun keeps the result of the filter cycle and stores it for the API replicas
+func (app *App) recordFilterRun(run utils.FilterRun) {
+	app.filterRuns.mu.Lock()
+	app.filterRuns.last = &run
+	app.filterRuns.mu.Unlock()
+	if err := app.dbStoreFilterRun(run); err != nil {
+		slog.Error("storing filter run:" + err.Error())
+	}
+}
+
+// lastFilterRun returns the last filter cycle of the indexer, which can run in another
+// instance. Falls back to the last cycle of this instance if it cannot be loaded.
+func (app *App) lastFilterRun() *utils.FilterRun {
+	run, err := app.dbGetFilterRun()
+	if err != nil {
+		slog.Error("loading filter run:" + err.Error())
+	}
+	if run != nil {
+		return run
+	}
+	app.filterRuns.mu.Lock()
+	defer app.filterRuns.mu.Unlock()
+	return app.filterRuns.last
 }
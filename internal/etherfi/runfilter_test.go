@@ -0,0 +1,28 @@
+package etherfi
+
+import "testing"
+
+func TestSplitStarts(t *testing.T) {
+	starts := map[string]uint64{
+		EVENT_DELEGATE: 200_000_000,
+		EVENT_TRANSFER: 200_000_010,
+		EVENT_TRADE:    100,
+		EVENT_DEPOSIT:  200_000_010 - LAGGING_BLOCKS,
+	}
+	current, lagging := splitStarts(starts)
+	if len(current) != 3 || len(lagging) != 1 || lagging[EVENT_TRADE] != 100 {
+		t.Fatalf("unexpected split %v, %v", current, lagging)
+	}
+	if lowestStart(current) != 200_000_010-LAGGING_BLOCKS {
+		t.Fatalf("unexpected lowest start %d", lowestStart(current))
+	}
+	types := eventTypesOf(lagging)
+	if len(types) != 1 || types[0] != indexedEvents[eventIdx(EVENT_TRADE)].eventType() {
+		t.Fatalf("unexpected event types %v", types)
+	}
+	// no lagging event types after a fresh start
+	current, lagging = splitStarts(map[string]uint64{EVENT_DELEGATE: 100, EVENT_TRADE: 100})
+	if len(current) != 2 || len(lagging) != 0 {
+		t.Fatalf("unexpected split %v, %v", current, lagging)
+	}
+}
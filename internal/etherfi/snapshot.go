@@ -0,0 +1,181 @@
+package etherfi
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/D8-X/d8x-etherfi/internal/merkle"
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SNAPSHOT_TREES is the number of snapshot trees kept in memory for proofs
+const SNAPSHOT_TREES = 4
+
+var (
+	ErrSnapshotNotFound     = errors.New("snapshot not found")
+	ErrAddressNotInSnapshot = errors.New("address not in snapshot")
+)
+
+// CreateSnapshot calculates the effective balances of the entire holder
+// universe at the given block, stores them and the Merkle root of the
+// (address, amount) leaves in the database. Addresses with a non-positive
+// effective balance are not part of the snapshot.
+func (app *App) CreateSnapshot(blockNumber uint64) (utils.APISnapshotResponse, error) {
+	res, err := app.Balances(utils.APIBalancesPayload{BlockNumber: blockNumber})
+	if err != nil {
+		return utils.APISnapshotResponse{}, err
+	}
+	entries := make([]utils.Balance, 0, len(res.Result))
+	for _, b := range res.Result {
+		if b.Amount == nil || b.Amount.Sign() <= 0 {
+			continue
+		}
+		entries = append(entries, b)
+	}
+	tree := snapshotTree(entries)
+	snap := utils.APISnapshotResponse{
+		BlockNumber: blockNumber,
+		MerkleRoot:  tree.Root().Hex(),
+		NumLeaves:   len(entries),
+	}
+	err = app.dbInsertSnapshot(snap, entries)
+	if err != nil {
+		return utils.APISnapshotResponse{}, err
+	}
+	slog.Info(fmt.Sprintf("stored snapshot for block %d with %d leaves, root %s", blockNumber, snap.NumLeaves, snap.MerkleRoot))
+	return snap, nil
+}
+
+// Snapshot returns the stored snapshot for the given block
+func (app *App) Snapshot(blockNumber uint64) (utils.APISnapshotResponse, error) {
+	query := `SELECT merkle_root, num_leaves FROM balance_snapshot WHERE chain_id=$1 AND pool_id=$2 AND block=$3`
+	snap := utils.APISnapshotResponse{BlockNumber: blockNumber}
+	err := app.Db.QueryRow(query, app.Sdk.ChainConfig.ChainId, app.PoolId, blockNumber).Scan(&snap.MerkleRoot, &snap.NumLeaves)
+	if err == sql.ErrNoRows {
+		return utils.APISnapshotResponse{}, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return utils.APISnapshotResponse{}, errors.New("Snapshot:" + err.Error())
+	}
+	return snap, nil
+}
+
+// SnapshotProof returns the leaf and sibling path for the given address
+// in the snapshot of the given block
+func (app *App) SnapshotProof(blockNumber uint64, addr string) (utils.APIProofResponse, error) {
+	snap, err := app.Snapshot(blockNumber)
+	if err != nil {
+		return utils.APIProofResponse{}, err
+	}
+	t, err := app.snapshotProofTree(snap)
+	if err != nil {
+		return utils.APIProofResponse{}, err
+	}
+	addr = strings.ToLower(addr)
+	amount, exists := t.amounts[addr]
+	if !exists {
+		return utils.APIProofResponse{}, ErrAddressNotInSnapshot
+	}
+	leaf := merkle.LeafHash(common.HexToAddress(addr), amount)
+	proof, err := t.tree.Proof(leaf)
+	if err != nil {
+		return utils.APIProofResponse{}, err
+	}
+	res := utils.APIProofResponse{
+		BlockNumber: blockNumber,
+		MerkleRoot:  snap.MerkleRoot,
+		Address:     addr,
+		Amount:      amount.String(),
+		Leaf:        leaf.Hex(),
+		Proof:       make([]string, 0, len(proof)),
+	}
+	for _, p := range proof {
+		res.Proof = append(res.Proof, p.Hex())
+	}
+	return res, nil
+}
+
+// snapshotTree builds the Merkle tree for the snapshot entries
+func snapshotTree(entries []utils.Balance) *merkle.Tree {
+	leaves := make([]common.Hash, 0, len(entries))
+	for _, e := range entries {
+		leaves = append(leaves, merkle.LeafHash(common.HexToAddress(e.Address), e.Amount))
+	}
+	return merkle.NewTree(leaves)
+}
+
+// proofTree is the Merkle tree of a stored snapshot and the amounts of its leaves
+type proofTree struct {
+	root    string
+	amounts map[string]*big.Int
+	tree    *merkle.Tree
+}
+
+// snapshotTrees caches the trees of the SNAPSHOT_TREES most recently built
+// snapshots, building a tree requires loading all entries of the snapshot
+type snapshotTrees struct {
+	mu     sync.Mutex
+	trees  map[uint64]*proofTree
+	blocks []uint64 // least recently built first
+}
+
+// get returns the cached tree of the snapshot, trees of replaced snapshots
+// (different root) are not returned
+func (c *snapshotTrees) get(block uint64, root string) (*proofTree, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, exists := c.trees[block]
+	if !exists || t.root != root {
+		return nil, false
+	}
+	return t, true
+}
+
+// put caches the tree of the snapshot and removes the oldest tree if
+// more than SNAPSHOT_TREES are cached
+func (c *snapshotTrees) put(block uint64, t *proofTree) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.trees == nil {
+		c.trees = make(map[uint64]*proofTree)
+	}
+	if _, exists := c.trees[block]; !exists {
+		c.blocks = append(c.blocks, block)
+	}
+	c.trees[block] = t
+	if len(c.blocks) > SNAPSHOT_TREES {
+		delete(c.trees, c.blocks[0])
+		c.blocks = c.blocks[1:]
+	}
+}
+
+// snapshotProofTree returns the tree of the snapshot, from the cache or built
+// from the stored entries
+func (app *App) snapshotProofTree(snap utils.APISnapshotResponse) (*proofTree, error) {
+	if t, exists := app.snapshots.get(snap.BlockNumber, snap.MerkleRoot); exists {
+		return t, nil
+	}
+	entries, err := app.dbGetSnapshotEntries(snap.BlockNumber)
+	if err != nil {
+		return nil, err
+	}
+	t := &proofTree{
+		root:    snap.MerkleRoot,
+		amounts: make(map[string]*big.Int, len(entries)),
+		tree:    snapshotTree(entries),
+	}
+	if t.tree.Root().Hex() != snap.MerkleRoot {
+		return nil, errors.New("SnapshotProof: stored root does not match entries")
+	}
+	for _, e := range entries {
+		t.amounts[e.Address] = e.Amount
+	}
+	app.snapshots.put(snap.BlockNumber, t)
+	return t, nil
+}
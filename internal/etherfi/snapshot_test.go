@@ -0,0 +1,24 @@
+package etherfi
+
+import "testing"
+
+func TestSnapshotTrees(t *testing.T) {
+	var c snapshotTrees
+	for block := uint64(1); block <= SNAPSHOT_TREES+1; block++ {
+		c.put(block, &proofTree{root: "0x1"})
+	}
+	if _, exists := c.get(1, "0x1"); exists {
+		t.Fatal("oldest tree not removed")
+	}
+	if _, exists := c.get(2, "0x1"); !exists {
+		t.Fatal("tree not cached")
+	}
+	// a replaced snapshot has a different root
+	if _, exists := c.get(2, "0x2"); exists {
+		t.Fatal("tree of replaced snapshot returned")
+	}
+	c.put(2, &proofTree{root: "0x2"})
+	if _, exists := c.get(2, "0x2"); !exists || len(c.blocks) != SNAPSHOT_TREES {
+		t.Fatalf("replaced tree not cached, %d blocks", len(c.blocks))
+	}
+}
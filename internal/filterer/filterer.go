@@ -5,19 +5,29 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"math/big"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/D8-X/d8x-etherfi/internal/metrics"
 	"github.com/D8-X/d8x-etherfi/internal/utils"
 	d8xcontracts "github.com/D8-X/d8x-futures-go-sdk/pkg/contracts"
-	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
 )
 
 type Filterer struct {
 	RpcMngr          utils.RpcHandler
 	PerpProxy        common.Address
 	PoolShareTknAddr common.Address
+	windows          map[*ethclient.Client]*window // log query window per rpc
+	store            WindowStore
+	windowMu         sync.Mutex
+	sources          map[EventType]source // decoders of the registered event types
+	perpFilterer     *d8xcontracts.IPerpetualManagerFilterer
+	erc20Filterer    *d8xcontracts.Erc20Filterer
 }
 
 type Delegate struct {
@@ -27,169 +37,240 @@ type Delegate struct {
 	BlockNr  int
 }
 
+func (d Delegate) Block() uint64 {
+	return uint64(d.BlockNr)
+}
+
 type Transfer struct {
 	From    string
 	To      string
 	BlockNr int
 }
 
-func NewFilterer(rpcUrls []string, perpProxy, poolShareTknAddr common.Address) (*Filterer, error) {
+func (t Transfer) Block() uint64 {
+	return uint64(t.BlockNr)
+}
+
+var (
+	// DelegateKind are the SetDelegate events of the perpetual manager
+	DelegateKind = Kind[Delegate](SetDelegateEvent)
+	// TransferKind are the Transfer events of the pool share token
+	TransferKind = Kind[Transfer](TokenTransferEvent)
+)
+
+func NewFilterer(rpcUrls []string, budget utils.RpcBudget, perpProxy, poolShareTknAddr common.Address) (*Filterer, error) {
 	var F Filterer
-	err := F.RpcMngr.Init(rpcUrls, 5, 5)
+	err := F.RpcMngr.Init(rpcUrls, budget.Capacity, budget.RefillRate)
 	if err != nil {
 		return nil, err
 	}
 	F.PerpProxy = perpProxy
 	F.PoolShareTknAddr = poolShareTknAddr
+	// the filterers only decode logs, queries are sent by filterRange
+	F.perpFilterer, err = d8xcontracts.NewIPerpetualManagerFilterer(perpProxy, nil)
+	if err != nil {
+		return nil, err
+	}
+	F.erc20Filterer, err = d8xcontracts.NewErc20Filterer(poolShareTknAddr, nil)
+	if err != nil {
+		return nil, err
+	}
+	perpAbi, err := d8xcontracts.IPerpetualManagerMetaData.GetAbi()
+	if err != nil {
+		return nil, err
+	}
+	erc20Abi, err := d8xcontracts.Erc20MetaData.GetAbi()
+	if err != nil {
+		return nil, err
+	}
+	Register(&F, DelegateKind, perpProxy, perpAbi.Events["SetDelegate"].ID, F.decodeDelegate)
+	Register(&F, TransferKind, poolShareTknAddr, erc20Abi.Events["Transfer"].ID, F.decodeTransfer)
 	return &F, nil
 }
 
-// processMultiPayEvents loops through blockchain events from the multipay contract and collects the data in
-// the logs slice
-func (F *Filterer) processDelegateEvents(iterator interface{}, logs *[]interface{}) {
-	it := iterator.(*d8xcontracts.IPerpetualManagerSetDelegateIterator)
-	for it.Next() {
-		var dlgt Delegate
-		event := it.Event
-		dlgt.Addr = strings.ToLower(event.Trader.Hex())
-		dlgt.Delegate = strings.ToLower(event.Delegate.Hex())
-		dlgt.Index = int(event.Index.Uint64())
-		dlgt.BlockNr = int(it.Event.Raw.BlockNumber)
-		*logs = append(*logs, dlgt)
+// decodeDelegate decodes a SetDelegate log of the perpetual manager
+func (F *Filterer) decodeDelegate(log types.Log) (Delegate, error) {
+	event, err := F.perpFilterer.ParseSetDelegate(log)
+	if err != nil {
+		return Delegate{}, err
 	}
+	return Delegate{
+		Addr:     strings.ToLower(event.Trader.Hex()),
+		Delegate: strings.ToLower(event.Delegate.Hex()),
+		Index:    int(event.Index.Uint64()),
+		BlockNr:  int(log.BlockNumber),
+	}, nil
 }
 
-// processMultiPayEvents loops through blockchain events from the multipay contract and collects the data in
-// the logs slice
-func (F *Filterer) processTransferEvents(iterator interface{}, logs *[]interface{}) {
-	it := iterator.(*d8xcontracts.Erc20TransferIterator)
-	for it.Next() {
-		var transfer Transfer
-		event := it.Event
-		transfer.From = strings.ToLower(event.From.Hex())
-		transfer.To = strings.ToLower(event.To.Hex())
-		transfer.BlockNr = int(it.Event.Raw.BlockNumber)
-		*logs = append(*logs, transfer)
+// decodeTransfer decodes a Transfer log of the pool share token
+func (F *Filterer) decodeTransfer(log types.Log) (Transfer, error) {
+	event, err := F.erc20Filterer.ParseTransfer(log)
+	if err != nil {
+		return Transfer{}, err
 	}
+	return Transfer{
+		From:    strings.ToLower(event.From.Hex()),
+		To:      strings.ToLower(event.To.Hex()),
+		BlockNr: int(log.BlockNumber),
+	}, nil
 }
 
 type EventType int
 
+func (e EventType) String() string {
+	switch e {
+	case SetDelegateEvent:
+		return "delegates"
+	case TokenTransferEvent:
+		return "transfers"
+	case TradeEvent:
+		return "trades"
+	case DepositEvent:
+		return "deposits"
+	case WithdrawEvent:
+		return "withdrawals"
+	case LiquidateEvent:
+		return "liquidations"
+	case SettleEvent:
+		return "settlements"
+	default:
+		return "unknown"
+	}
+}
+
 const (
 	// SetDelegateEvent represents the SetDelegate event
 	SetDelegateEvent EventType = iota
 	// TokenTransferEvent represents some other event type
 	TokenTransferEvent
+	// TradeEvent represents the Trade event of the perpetual manager
+	TradeEvent
+	// DepositEvent represents the TokensDeposited event of the perpetual manager
+	DepositEvent
+	// WithdrawEvent represents the TokensWithdrawn event of the perpetual manager
+	WithdrawEvent
+	// LiquidateEvent represents the Liquidate event of the perpetual manager
+	LiquidateEvent
+	// SettleEvent represents the Settle event of the perpetual manager
+	SettleEvent
 )
 
-func (F *Filterer) FilterTransferEvts(startBlock, endBlock uint64) ([]interface{}, uint64, error) {
-	data, nowblock, err := F.FilterEvents(TokenTransferEvent, startBlock, endBlock)
+func (F *Filterer) FilterTransferEvts(ctx context.Context, startBlock, endBlock uint64) ([]Transfer, uint64, error) {
+	events, nowblock, err := F.FilterEvents(ctx, []EventType{TokenTransferEvent}, startBlock, endBlock)
 	if err != nil {
-		return nil, nowblock, errors.New("TransferEvents:" + err.Error())
+		return Decoded(events, TransferKind), nowblock, fmt.Errorf("TransferEvents:%w", err)
 	}
-	return data, nowblock, nil
+	return Decoded(events, TransferKind), nowblock, nil
 }
 
 // FilterDelegates collects historical delegate events and updates the database
 // set endBlock to zero to filter up to the latest block
-func (F *Filterer) FilterDelegateEvts(startBlock, endBlock uint64) ([]interface{}, uint64, error) {
-	data, nowblock, err := F.FilterEvents(SetDelegateEvent, startBlock, endBlock)
+func (F *Filterer) FilterDelegateEvts(ctx context.Context, startBlock, endBlock uint64) ([]Delegate, uint64, error) {
+	events, nowblock, err := F.FilterEvents(ctx, []EventType{SetDelegateEvent}, startBlock, endBlock)
 	if err != nil {
-		return nil, nowblock, errors.New("TransferEvents:" + err.Error())
+		return Decoded(events, DelegateKind), nowblock, fmt.Errorf("DelegateEvents:%w", err)
 	}
-	return data, nowblock, nil
+	return Decoded(events, DelegateKind), nowblock, nil
 }
 
-func (F *Filterer) FilterEvents(eventType EventType, startBlock, endBlock uint64) ([]interface{}, uint64, error) {
+// FilterEvents collects the events of the given types from startBlock to endBlock (0 for the latest block)
+// in batches and returns them with the last filtered block. If ctx is canceled, filtering stops
+// between batches and the events of the completed batches are returned together with the last
+// completed block and ctx.Err().
+func (F *Filterer) FilterEvents(ctx context.Context, eventTypes []EventType, startBlock, endBlock uint64) (Events, uint64, error) {
 	client := F.RpcMngr.GetNextRpc()
-	header, err := client.HeaderByNumber(context.Background(), nil)
+	endBlock, err := F.endBlock(client, endBlock)
 	if err != nil {
-		return nil, 0, errors.New("failed to get block header: " + err.Error())
-	}
-	nowBlock := header.Number.Uint64()
-	if endBlock == 0 {
-		endBlock = nowBlock
+		return nil, 0, err
 	}
 	if endBlock < startBlock {
 		return nil, 0, errors.New("endblock must be after startblock")
 	}
-	var ctrct interface{}
-	var name string
-	switch eventType {
-	case SetDelegateEvent:
-		ctrct, err = d8xcontracts.NewIPerpetualManager(F.PerpProxy, client)
-		name = "delegates"
-	case TokenTransferEvent:
-		ctrct, err = d8xcontracts.NewErc20(F.PoolShareTknAddr, client)
-		name = "transfers"
-	default:
-		return nil, 0, errors.New("unsupported event type")
+	events, lastBlock, err := F.filterRange(ctx, client, eventTypes, startBlock, endBlock, F.window(client))
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			slog.Info(fmt.Sprintf("Reading %v stopped before block %d", eventTypes, lastBlock+1))
+			return events, lastBlock, err
+		}
+		return events, 0, err
+	}
+	slog.Info("Reading events completed.")
+	return events, endBlock, nil
+}
+
+// endBlock returns the requested end block, limited to the current chain head (also for 0)
+func (F *Filterer) endBlock(client *ethclient.Client, endBlock uint64) (uint64, error) {
+	F.RpcMngr.WaitForToken(client)
+	header, err := client.HeaderByNumber(context.Background(), nil)
+	if err != nil {
+		F.RpcMngr.ReportError(client, false)
+		return 0, errors.New("failed to get block header: " + err.Error())
 	}
+	nowBlock := header.Number.Uint64()
+	metrics.ChainHead.Set(float64(nowBlock))
+	if endBlock == 0 || endBlock > nowBlock {
+		endBlock = nowBlock
+	}
+	return endBlock, nil
+}
 
+// filterRange collects the events of the given types from startBlock to endBlock on the given rpc,
+// with one log query for all types per window of the rpc. Queries rejected because of their range
+// or size are retried with a smaller window, other failures with the same window. Returns the
+// events and the last block of the completed windows.
+func (F *Filterer) filterRange(ctx context.Context, client *ethclient.Client, eventTypes []EventType, startBlock, endBlock uint64, w *window) (Events, uint64, error) {
+	query, err := F.logQuery(eventTypes)
 	if err != nil {
 		return nil, 0, err
 	}
-	var logs []interface{}
+	events := newEvents(eventTypes)
 	var reportCount int
-	var pathLen = float64(nowBlock - startBlock)
-	// filter payments in batches of 32_768 (and decreasing) blocks to avoid RPC limit
-	deltaBlock := uint64(10_000)
-	for trial := 0; trial < 7; trial++ {
-		err = nil
-		if trial > 0 {
-			msg := fmt.Sprintf("Retrying with num blocks=%d (%d/%d)...", deltaBlock, trial, 7)
+	var pathLen = float64(endBlock - startBlock + 1)
+	for trial := 0; startBlock <= endBlock; {
+		if ctx.Err() != nil {
+			// stop between windows, events up to startBlock-1 are complete
+			return events, startBlock - 1, ctx.Err()
+		}
+		batchEnd := min(startBlock+w.get()-1, endBlock)
+		if reportCount%100 == 0 && pathLen > PARALLEL_CHUNK {
+			msg := fmt.Sprintf("Reading %v from onchain: %.0f%%", eventTypes, 100-100*float64(endBlock-startBlock+1)/pathLen)
 			slog.Info(msg)
-			time.Sleep(time.Duration(5*trial) * time.Second)
 		}
-		for {
-			endBlock := startBlock + deltaBlock
-			if reportCount%100 == 0 {
-				msg := fmt.Sprintf("Reading %s from onchain: %.0f%%", name, 100-100*float64(nowBlock-startBlock)/pathLen)
-				slog.Info(msg)
-			}
-			// Create an event iterator for events
-			var endBlockPtr *uint64 = &endBlock
-			if endBlock >= nowBlock {
-				endBlockPtr = nil
-			}
-			opts := &bind.FilterOpts{
-				Start:   startBlock,  // Starting block number
-				End:     endBlockPtr, // Ending block (nil for latest)
-				Context: context.Background(),
+		query.FromBlock = new(big.Int).SetUint64(startBlock)
+		query.ToBlock = new(big.Int).SetUint64(batchEnd)
+		F.RpcMngr.WaitForToken(client)
+		logs, err := client.FilterLogs(ctx, query)
+		if err != nil && ctx.Err() != nil {
+			// interrupted, events up to startBlock-1 are complete
+			return events, startBlock - 1, ctx.Err()
+		}
+		if err != nil {
+			slog.Info("Failed to filter logs: " + err.Error())
+			F.RpcMngr.ReportError(client, trial < 6)
+			trial++
+			if trial == 7 {
+				return events, startBlock - 1, err
 			}
-			var iterator interface{}
-			F.RpcMngr.WaitForToken(client)
-			if eventType == SetDelegateEvent {
-				iterator, err = ctrct.(*d8xcontracts.IPerpetualManager).FilterSetDelegate(opts, []common.Address{}, []common.Address{})
-				if err != nil {
-					break
-				}
-				F.processDelegateEvents(iterator, &logs)
-			} else if eventType == TokenTransferEvent {
-				iterator, err = ctrct.(*d8xcontracts.Erc20).FilterTransfer(opts, []common.Address{}, []common.Address{})
-				if err != nil {
-					break
-				}
-				F.processTransferEvents(iterator, &logs)
-			} else {
-				return nil, 0, errors.New("unknown event")
+			if isRangeError(err) && w.shrink() {
+				F.windowChanged(client, w)
 			}
-
-			if endBlock >= nowBlock {
-				break
+			msg := fmt.Sprintf("Retrying with num blocks=%d (%d/%d)...", w.get(), trial, 7)
+			slog.Info(msg)
+			select {
+			case <-time.After(time.Duration(5*trial) * time.Second):
+			case <-ctx.Done():
 			}
-			startBlock = endBlock + 1
-			reportCount += 1
+			continue
 		}
-		if err == nil {
-			break
+		if err := F.decode(logs, events); err != nil {
+			return events, startBlock - 1, err
 		}
-		slog.Info("Failed to create event iterator: " + err.Error())
-		deltaBlock = deltaBlock / 2
-	}
-	if err != nil {
-		return logs, 0, err
+		trial = 0
+		if w.grow() {
+			F.windowChanged(client, w)
+		}
+		startBlock = batchEnd + 1
+		reportCount += 1
 	}
-	slog.Info("Reading events completed.")
-	return logs, nowBlock, nil
+	return events, endBlock, nil
 }
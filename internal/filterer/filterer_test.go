@@ -1,6 +1,7 @@
 package filterer
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
@@ -17,17 +18,16 @@ func TestFilterDelegateEvts(t *testing.T) {
 		t.FailNow()
 	}
 	fmt.Println(c.PerpAddr.Hex())
-	f, err := NewFilterer(c.RpcUrlsFltr, c.PerpAddr, common.Address{})
+	f, err := NewFilterer(c.RpcUrlsFltr, c.RpcBudgetFltr, c.PerpAddr, common.Address{})
 	if err != nil {
 		t.FailNow()
 	}
-	delegates, nowblock, err := f.FilterDelegateEvts(30021418, 0)
+	delegates, nowblock, err := f.FilterDelegateEvts(context.Background(), 30021418, 0)
 	if err != nil {
 		t.FailNow()
 	}
 	fmt.Printf("found %d events up to block %d\n", len(delegates), nowblock)
-	for _, dlgt := range delegates {
-		d := dlgt.(*Delegate)
+	for _, d := range delegates {
 		fmt.Printf("from %s to %s with index %d at block %d\n", d.Addr, d.Delegate, d.Index, d.BlockNr)
 	}
 }
@@ -0,0 +1,144 @@
+package filterer
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Event is a decoded log
+type Event interface {
+	Block() uint64
+}
+
+// Kind is an event type whose logs decode to events of type T. Events are
+// registered and read by their kind, so that the types are checked at compile time.
+type Kind[T Event] EventType
+
+// ErrSkipEvent is returned by decoders for logs that are not indexed,
+// e.g. of perpetuals of other pools
+var ErrSkipEvent = errors.New("event skipped")
+
+// Decoder decodes a log into an event
+type Decoder[T Event] func(log types.Log) (T, error)
+
+// Events are the decoded events per event type, in block order.
+// Use Decoded to read the events of a kind.
+type Events map[EventType]eventList
+
+// eventList are the events of one kind
+type eventList interface {
+	Len() int
+}
+
+// list implements eventList for the events of type T
+type list[T Event] []T
+
+func (l list[T]) Len() int {
+	return len(l)
+}
+
+// Len returns the number of events of the event type
+func (e Events) Len(eventType EventType) int {
+	if l := e[eventType]; l != nil {
+		return l.Len()
+	}
+	return 0
+}
+
+// Decoded returns the events of the kind
+func Decoded[T Event](events Events, kind Kind[T]) []T {
+	l, _ := events[EventType(kind)].(list[T])
+	return l
+}
+
+// source are the logs of an event type
+type source struct {
+	address common.Address
+	topic   common.Hash
+	decode  func(log types.Log, events Events) error // decodes the log and appends it to events
+}
+
+// Register adds an event kind: logs with the topic emitted by the address are
+// passed to decode. The logs of all event types of a query are requested at once.
+func Register[T Event](F *Filterer, kind Kind[T], address common.Address, topic common.Hash, decode Decoder[T]) {
+	if F.sources == nil {
+		F.sources = make(map[EventType]source)
+	}
+	eventType := EventType(kind)
+	F.sources[eventType] = source{
+		address: address,
+		topic:   topic,
+		decode: func(log types.Log, events Events) error {
+			event, err := decode(log)
+			if errors.Is(err, ErrSkipEvent) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			l, _ := events[eventType].(list[T])
+			events[eventType] = append(l, event)
+			return nil
+		},
+	}
+}
+
+// newEvents returns empty events of the event types
+func newEvents(eventTypes []EventType) Events {
+	events := make(Events, len(eventTypes))
+	for _, eventType := range eventTypes {
+		events[eventType] = nil
+	}
+	return events
+}
+
+// logQuery returns a log query for the addresses and topics of the event types
+func (F *Filterer) logQuery(eventTypes []EventType) (ethereum.FilterQuery, error) {
+	var query ethereum.FilterQuery
+	topics := make([]common.Hash, 0, len(eventTypes))
+	for _, eventType := range eventTypes {
+		src, exists := F.sources[eventType]
+		if !exists {
+			return query, errors.New("unsupported event type")
+		}
+		if !containsAddress(query.Addresses, src.address) {
+			query.Addresses = append(query.Addresses, src.address)
+		}
+		topics = append(topics, src.topic)
+	}
+	query.Topics = [][]common.Hash{topics}
+	return query, nil
+}
+
+// decode dispatches the logs to the decoders of the event types in events. Logs of
+// other contracts with the same topic (the query matches any address-topic combination)
+// are ignored.
+func (F *Filterer) decode(logs []types.Log, events Events) error {
+	for _, log := range logs {
+		if log.Removed || len(log.Topics) == 0 {
+			continue
+		}
+		for eventType := range events {
+			src := F.sources[eventType]
+			if log.Address != src.address || log.Topics[0] != src.topic {
+				continue
+			}
+			if err := src.decode(log, events); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func containsAddress(addrs []common.Address, addr common.Address) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package filterer
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+	d8xcontracts "github.com/D8-X/d8x-futures-go-sdk/pkg/contracts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestDecodeDispatch(t *testing.T) {
+	perp := common.HexToAddress("0x8f8BccE4c180B699F81499005281fA89440D1e95")
+	shTkn := common.HexToAddress("0xc21950e41121C2c52DC8074713514ddBAD678258")
+	f, err := NewFilterer([]string{"http://localhost:8545"}, utils.RpcBudget{Capacity: 1, RefillRate: 1}, perp, shTkn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := f.logQuery([]EventType{SetDelegateEvent, TokenTransferEvent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(query.Addresses) != 2 || len(query.Topics) != 1 || len(query.Topics[0]) != 2 {
+		t.Fatalf("unexpected query %+v", query)
+	}
+	erc20Abi, _ := d8xcontracts.Erc20MetaData.GetAbi()
+	from := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	to := common.HexToAddress("0x00000000000000000000000000000000000000bb")
+	data, _ := erc20Abi.Events["Transfer"].Inputs.NonIndexed().Pack(big.NewInt(5))
+	transfer := types.Log{
+		Address:     shTkn,
+		Topics:      []common.Hash{erc20Abi.Events["Transfer"].ID, common.BytesToHash(from.Bytes()), common.BytesToHash(to.Bytes())},
+		Data:        data,
+		BlockNumber: 42,
+	}
+	// same topic emitted by another token
+	other := transfer
+	other.Address = perp
+	events := newEvents([]EventType{SetDelegateEvent, TokenTransferEvent})
+	if err := f.decode([]types.Log{transfer, other}, events); err != nil {
+		t.Fatal(err)
+	}
+	transfers := Decoded(events, TransferKind)
+	if len(transfers) != 1 || events.Len(SetDelegateEvent) != 0 {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	exp := Transfer{From: "0x00000000000000000000000000000000000000aa", To: "0x00000000000000000000000000000000000000bb", BlockNr: 42}
+	if transfers[0] != exp {
+		t.Fatalf("unexpected transfer %+v", transfers[0])
+	}
+}
@@ -0,0 +1,134 @@
+package filterer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// PARALLEL_CHUNK is the number of blocks per chunk of FilterEventsParallel,
+// the unit of work of a worker and of the hand-off to the handler
+const PARALLEL_CHUNK = 50_000
+
+// ChunkHandler receives the events of the blocks [from, to]
+type ChunkHandler func(events Events, from, to uint64) error
+
+// chunkFilter filters the events of the blocks [from, to] for the given worker
+type chunkFilter func(ctx context.Context, worker int, from, to uint64) (Events, error)
+
+// chunkResult are the events of a chunk filtered by a worker
+type chunkResult struct {
+	events Events
+	err    error
+}
+
+// FilterEventsParallel collects the events of the given types from startBlock to endBlock (0 for the latest block).
+// The range is split into chunks that are filtered concurrently by the given number of workers,
+// worker k uses rpc k (modulo the number of rpcs) and the adaptive window size of the rpc. The chunks
+// are passed to handle in block order, so that handle can checkpoint the progress. Returns the
+// last block passed to handle (startBlock-1 if none). On failure or if ctx is canceled, the
+// chunks after the last handled chunk are dropped.
+func (F *Filterer) FilterEventsParallel(ctx context.Context, eventTypes []EventType, startBlock, endBlock uint64, workers int, handle ChunkHandler) (uint64, error) {
+	lastBlock := startBlock - 1
+	endBlock, err := F.endBlock(F.RpcMngr.GetNextRpc(), endBlock)
+	if err != nil {
+		return lastBlock, err
+	}
+	if endBlock < startBlock {
+		// no new blocks
+		return lastBlock, nil
+	}
+	filter := func(ctx context.Context, worker int, from, to uint64) (Events, error) {
+		client := F.RpcMngr.RpcClients[worker%len(F.RpcMngr.RpcClients)]
+		events, _, err := F.filterRange(ctx, client, eventTypes, from, to, F.window(client))
+		return events, err
+	}
+	return filterParallel(ctx, eventTypes, startBlock, endBlock, workers, filter, handle)
+}
+
+// filterParallel filters the chunks of [startBlock, endBlock] with the given number of
+// workers and passes them to handle in block order, see FilterEventsParallel
+func filterParallel(ctx context.Context, eventTypes []EventType, startBlock, endBlock uint64, workers int, filter chunkFilter, handle ChunkHandler) (uint64, error) {
+	lastBlock := startBlock - 1
+	numChunks := int((endBlock-startBlock)/PARALLEL_CHUNK) + 1
+	workers = max(1, min(workers, numChunks))
+	chunk := func(k int) (uint64, uint64) {
+		from := startBlock + uint64(k)*PARALLEL_CHUNK
+		return from, min(from+PARALLEL_CHUNK-1, endBlock)
+	}
+	if numChunks > 1 {
+		slog.Info(fmt.Sprintf("Reading %v from block %d to %d in %d chunks with %d workers",
+			eventTypes, startBlock, endBlock, numChunks, workers))
+	}
+
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make([]chan chunkResult, numChunks)
+	for k := range results {
+		results[k] = make(chan chunkResult, 1)
+	}
+	// at most 2 chunks per worker are filtered ahead of the handled chunk
+	slots := make(chan struct{}, 2*workers)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers + 1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		for k := 0; k < numChunks; k++ {
+			select {
+			case slots <- struct{}{}:
+			case <-workCtx.Done():
+				return
+			}
+			select {
+			case jobs <- k:
+			case <-workCtx.Done():
+				return
+			}
+		}
+	}()
+	for n := 0; n < workers; n++ {
+		go func() {
+			defer wg.Done()
+			for k := range jobs {
+				from, to := chunk(k)
+				events, err := filter(workCtx, n, from, to)
+				results[k] <- chunkResult{events: events, err: err}
+			}
+		}()
+	}
+
+	for k := 0; k < numChunks; k++ {
+		var res chunkResult
+		select {
+		case res = <-results[k]:
+		case <-ctx.Done():
+			res.err = ctx.Err()
+		}
+		if res.err == nil {
+			from, to := chunk(k)
+			res.err = handle(res.events, from, to)
+			if res.err == nil {
+				lastBlock = to
+			}
+			if numChunks > 1 && (k+1)%10 == 0 {
+				slog.Info(fmt.Sprintf("Reading %v from onchain: %d/%d chunks", eventTypes, k+1, numChunks))
+			}
+		}
+		if res.err != nil {
+			cancel()
+			wg.Wait()
+			if errors.Is(res.err, context.Canceled) && ctx.Err() != nil {
+				slog.Info(fmt.Sprintf("Reading %v stopped before block %d", eventTypes, lastBlock+1))
+				return lastBlock, ctx.Err()
+			}
+			return lastBlock, res.err
+		}
+		<-slots
+	}
+	wg.Wait()
+	return lastBlock, nil
+}
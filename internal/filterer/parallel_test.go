@@ -0,0 +1,99 @@
+package filterer
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFilterParallelOrder(t *testing.T) {
+	start := uint64(1000)
+	end := start + 5*PARALLEL_CHUNK - 1
+	// early chunks take longest so that later chunks complete first
+	filter := func(ctx context.Context, worker int, from, to uint64) (Events, error) {
+		time.Sleep(time.Duration(end-from) / PARALLEL_CHUNK * 5 * time.Millisecond)
+		return nil, nil
+	}
+	var handled []uint64
+	handle := func(events Events, from, to uint64) error {
+		handled = append(handled, from)
+		return nil
+	}
+	last, err := filterParallel(context.Background(), nil, start, end, 4, filter, handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint64{start, start + PARALLEL_CHUNK, start + 2*PARALLEL_CHUNK, start + 3*PARALLEL_CHUNK, start + 4*PARALLEL_CHUNK}
+	if last != end || !slices.Equal(handled, want) {
+		t.Fatalf("unexpected hand-off %v, last block %d", handled, last)
+	}
+}
+
+func TestFilterParallelError(t *testing.T) {
+	start := uint64(1000)
+	end := start + 5*PARALLEL_CHUNK - 1
+	errRpc := errors.New("rpc failed")
+	filter := func(ctx context.Context, worker int, from, to uint64) (Events, error) {
+		if from == start+2*PARALLEL_CHUNK {
+			return nil, errRpc
+		}
+		return nil, nil
+	}
+	var handled int
+	handle := func(events Events, from, to uint64) error {
+		handled++
+		return nil
+	}
+	last, err := filterParallel(context.Background(), nil, start, end, 3, filter, handle)
+	if !errors.Is(err, errRpc) {
+		t.Fatalf("expected rpc error, got %v", err)
+	}
+	if last != start+2*PARALLEL_CHUNK-1 || handled != 2 {
+		t.Fatalf("unexpected last block %d after %d chunks", last, handled)
+	}
+
+	// a failing handler stops before its chunk
+	handle = func(events Events, from, to uint64) error {
+		if from > start {
+			return errRpc
+		}
+		return nil
+	}
+	filter = func(ctx context.Context, worker int, from, to uint64) (Events, error) {
+		return nil, nil
+	}
+	last, err = filterParallel(context.Background(), nil, start, end, 3, filter, handle)
+	if !errors.Is(err, errRpc) || last != start+PARALLEL_CHUNK-1 {
+		t.Fatalf("unexpected result %d, %v", last, err)
+	}
+}
+
+func TestFilterParallelCancel(t *testing.T) {
+	start := uint64(1000)
+	end := start + 5*PARALLEL_CHUNK - 1
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// chunks after the second one wait for the cancellation
+	filter := func(ctx context.Context, worker int, from, to uint64) (Events, error) {
+		if from >= start+2*PARALLEL_CHUNK {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return nil, nil
+	}
+	handle := func(events Events, from, to uint64) error {
+		if from == start+PARALLEL_CHUNK {
+			cancel()
+		}
+		return nil
+	}
+	last, err := filterParallel(ctx, nil, start, end, 2, filter, handle)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+	if last != start+2*PARALLEL_CHUNK-1 {
+		t.Fatalf("unexpected last block %d", last)
+	}
+}
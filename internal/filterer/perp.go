@@ -0,0 +1,211 @@
+package filterer
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"strings"
+
+	"github.com/D8-X/d8x-etherfi/internal/metrics"
+	d8xcontracts "github.com/D8-X/d8x-futures-go-sdk/pkg/contracts"
+	d8xutils "github.com/D8-X/d8x-futures-go-sdk/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// LogRef identifies the log of an event
+type LogRef struct {
+	BlockNr  int
+	TxHash   string
+	LogIndex int
+}
+
+func (l LogRef) Block() uint64 {
+	return uint64(l.BlockNr)
+}
+
+func logRef(log types.Log) LogRef {
+	return LogRef{BlockNr: int(log.BlockNumber), TxHash: log.TxHash.Hex(), LogIndex: int(log.Index)}
+}
+
+// Trade is a trade of a trader in a perpetual. Amounts are converted from
+// ABDK fixed point, BC in base currency and CC in collateral currency.
+type Trade struct {
+	PerpetualId   int32
+	Trader        string
+	AmountBC      float64 // signed trade amount
+	Price         float64
+	NewPositionBC float64 // position size after the trade
+	FeeCC         float64
+	PnlCC         float64
+	OrderDigest   string
+	LogRef
+}
+
+// MarginChange is a deposit, withdrawal or settlement of collateral of a trader in a perpetual
+type MarginChange struct {
+	PerpetualId int32
+	Trader      string
+	AmountCC    float64
+	LogRef
+}
+
+// Liquidation is the liquidation of a position of a trader in a perpetual
+type Liquidation struct {
+	PerpetualId   int32
+	Trader        string
+	Liquidator    string
+	AmountBC      float64 // liquidated amount
+	Price         float64
+	NewPositionBC float64 // position size after the liquidation
+	FeeCC         float64
+	PnlCC         float64
+	LogRef
+}
+
+var (
+	// TradeKind are the Trade events of the perpetual manager
+	TradeKind = Kind[Trade](TradeEvent)
+	// DepositKind are the TokensDeposited events of the perpetual manager
+	DepositKind = Kind[MarginChange](DepositEvent)
+	// WithdrawKind are the TokensWithdrawn events of the perpetual manager
+	WithdrawKind = Kind[MarginChange](WithdrawEvent)
+	// LiquidateKind are the Liquidate events of the perpetual manager
+	LiquidateKind = Kind[Liquidation](LiquidateEvent)
+	// SettleKind are the Settle events of the perpetual manager, the amount
+	// is emitted in decimal-N units of the pool token
+	SettleKind = Kind[MarginChange](SettleEvent)
+)
+
+// skipInvalid returns a decoder that skips the logs decode fails or panics on. The perpetual events
+// share the log query with the delegate and transfer events, an undecodable log must not
+// stop the indexing of the balances.
+func skipInvalid[T Event](kind Kind[T], decode Decoder[T]) Decoder[T] {
+	return func(log types.Log) (event T, err error) {
+		defer func() {
+			// the bindings leave fields of malformed logs nil
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%v", r)
+			}
+			if err != nil && !errors.Is(err, ErrSkipEvent) {
+				slog.Error(fmt.Sprintf("skipping %s log %s/%d:%s", EventType(kind), log.TxHash.Hex(), log.Index, err.Error()))
+				metrics.LogsSkipped.WithLabelValues(EventType(kind).String()).Inc()
+				err = ErrSkipEvent
+			}
+		}()
+		return decode(log)
+	}
+}
+
+// RegisterPerpEvents registers the trader events of the perpetual manager. Events of
+// perpetuals other than perpIds are skipped, settled amounts are converted with the
+// decimals of the pool token.
+func (F *Filterer) RegisterPerpEvents(perpIds []int32, poolTknDecimals uint8) error {
+	perpAbi, err := d8xcontracts.IPerpetualManagerMetaData.GetAbi()
+	if err != nil {
+		return err
+	}
+	perps := make(map[int32]bool, len(perpIds))
+	for _, id := range perpIds {
+		perps[id] = true
+	}
+	// perpId returns the perpetual id if it is one of perpIds
+	perpId := func(id *big.Int) (int32, error) {
+		if !perps[int32(id.Int64())] {
+			return 0, ErrSkipEvent
+		}
+		return int32(id.Int64()), nil
+	}
+	Register(F, TradeKind, F.PerpProxy, perpAbi.Events["Trade"].ID, skipInvalid(TradeKind, func(log types.Log) (Trade, error) {
+		event, err := F.perpFilterer.ParseTrade(log)
+		if err != nil {
+			return Trade{}, err
+		}
+		id, err := perpId(event.PerpetualId)
+		if err != nil {
+			return Trade{}, err
+		}
+		return Trade{
+			PerpetualId:   id,
+			Trader:        strings.ToLower(event.Trader.Hex()),
+			AmountBC:      d8xutils.ABDKToFloat64(event.Order.FAmount),
+			Price:         d8xutils.ABDKToFloat64(event.Price),
+			NewPositionBC: d8xutils.ABDKToFloat64(event.NewPositionSizeBC),
+			FeeCC:         d8xutils.ABDKToFloat64(event.FFeeCC),
+			PnlCC:         d8xutils.ABDKToFloat64(event.FPnlCC),
+			OrderDigest:   common.Hash(event.OrderDigest).Hex(),
+			LogRef:        logRef(log),
+		}, nil
+	}))
+	Register(F, DepositKind, F.PerpProxy, perpAbi.Events["TokensDeposited"].ID, skipInvalid(DepositKind, func(log types.Log) (MarginChange, error) {
+		event, err := F.perpFilterer.ParseTokensDeposited(log)
+		if err != nil {
+			return MarginChange{}, err
+		}
+		id, err := perpId(event.PerpetualId)
+		if err != nil {
+			return MarginChange{}, err
+		}
+		return MarginChange{
+			PerpetualId: id,
+			Trader:      strings.ToLower(event.Trader.Hex()),
+			AmountCC:    d8xutils.ABDKToFloat64(event.Amount),
+			LogRef:      logRef(log),
+		}, nil
+	}))
+	Register(F, WithdrawKind, F.PerpProxy, perpAbi.Events["TokensWithdrawn"].ID, skipInvalid(WithdrawKind, func(log types.Log) (MarginChange, error) {
+		event, err := F.perpFilterer.ParseTokensWithdrawn(log)
+		if err != nil {
+			return MarginChange{}, err
+		}
+		id, err := perpId(event.PerpetualId)
+		if err != nil {
+			return MarginChange{}, err
+		}
+		return MarginChange{
+			PerpetualId: id,
+			Trader:      strings.ToLower(event.Trader.Hex()),
+			AmountCC:    d8xutils.ABDKToFloat64(event.Amount),
+			LogRef:      logRef(log),
+		}, nil
+	}))
+	Register(F, LiquidateKind, F.PerpProxy, perpAbi.Events["Liquidate"].ID, skipInvalid(LiquidateKind, func(log types.Log) (Liquidation, error) {
+		event, err := F.perpFilterer.ParseLiquidate(log)
+		if err != nil {
+			return Liquidation{}, err
+		}
+		id, err := perpId(event.PerpetualId)
+		if err != nil {
+			return Liquidation{}, err
+		}
+		return Liquidation{
+			PerpetualId:   id,
+			Trader:        strings.ToLower(event.Trader.Hex()),
+			Liquidator:    strings.ToLower(event.Liquidator.Hex()),
+			AmountBC:      d8xutils.ABDKToFloat64(event.AmountLiquidatedBC),
+			Price:         d8xutils.ABDKToFloat64(event.LiquidationPrice),
+			NewPositionBC: d8xutils.ABDKToFloat64(event.NewPositionSizeBC),
+			FeeCC:         d8xutils.ABDKToFloat64(event.FFeeCC),
+			PnlCC:         d8xutils.ABDKToFloat64(event.FPnlCC),
+			LogRef:        logRef(log),
+		}, nil
+	}))
+	Register(F, SettleKind, F.PerpProxy, perpAbi.Events["Settle"].ID, skipInvalid(SettleKind, func(log types.Log) (MarginChange, error) {
+		event, err := F.perpFilterer.ParseSettle(log)
+		if err != nil {
+			return MarginChange{}, err
+		}
+		id, err := perpId(event.PerpetualId)
+		if err != nil {
+			return MarginChange{}, err
+		}
+		return MarginChange{
+			PerpetualId: id,
+			Trader:      strings.ToLower(event.Trader.Hex()),
+			AmountCC:    d8xutils.DecNToFloat(event.Amount, poolTknDecimals),
+			LogRef:      logRef(log),
+		}, nil
+	}))
+	return nil
+}
@@ -0,0 +1,51 @@
+package filterer
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+	d8xcontracts "github.com/D8-X/d8x-futures-go-sdk/pkg/contracts"
+	d8xutils "github.com/D8-X/d8x-futures-go-sdk/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestDecodePerpEvents(t *testing.T) {
+	perp := common.HexToAddress("0x8f8BccE4c180B699F81499005281fA89440D1e95")
+	shTkn := common.HexToAddress("0xc21950e41121C2c52DC8074713514ddBAD678258")
+	f, err := NewFilterer([]string{"http://localhost:8545"}, utils.RpcBudget{Capacity: 1, RefillRate: 1}, perp, shTkn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.RegisterPerpEvents([]int32{100001}, 18); err != nil {
+		t.Fatal(err)
+	}
+	perpAbi, _ := d8xcontracts.IPerpetualManagerMetaData.GetAbi()
+	trader := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	deposit := func(perpId int64, block uint64) types.Log {
+		data, _ := perpAbi.Events["TokensDeposited"].Inputs.NonIndexed().Pack(d8xutils.Float64ToABDK(1.5))
+		return types.Log{
+			Address:     perp,
+			Topics:      []common.Hash{perpAbi.Events["TokensDeposited"].ID, common.BigToHash(big.NewInt(perpId)), common.BytesToHash(trader.Bytes())},
+			Data:        data,
+			BlockNumber: block,
+			Index:       3,
+		}
+	}
+	events := newEvents([]EventType{DepositEvent, WithdrawEvent})
+	// the deposit into a perpetual of another pool and an undecodable log are skipped
+	invalid := deposit(100001, 42)
+	invalid.Data = nil
+	if err := f.decode([]types.Log{deposit(200001, 41), invalid, deposit(100001, 42)}, events); err != nil {
+		t.Fatal(err)
+	}
+	deposits := Decoded(events, DepositKind)
+	if len(deposits) != 1 || events.Len(WithdrawEvent) != 0 {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	d := deposits[0]
+	if d.PerpetualId != 100001 || d.Trader != "0x00000000000000000000000000000000000000aa" || d.AmountCC != 1.5 || d.Block() != 42 || d.LogIndex != 3 {
+		t.Fatalf("unexpected deposit %+v", d)
+	}
+}
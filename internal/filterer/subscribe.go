@@ -0,0 +1,94 @@
+package filterer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/D8-X/d8x-etherfi/internal/metrics"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// WS_CONFIRMATIONS is the number of blocks the head must be ahead of a block before
+// its logs are queried, so that short reorgs are settled
+const WS_CONFIRMATIONS = 2
+
+// Subscribe streams the events of the given types from startBlock on. New heads of the
+// websocket rpc wsUrl trigger the log queries: the blocks up to the first head are filtered
+// with FilterEventsParallel, on each later head the blocks up to WS_CONFIRMATIONS below it
+// are queried with eth_getLogs on the filterer rpcs and passed to handle in order. Logs are
+// not taken from a log subscription, which can deliver them after their block was handled.
+// Returns the last handled block when ctx is canceled or the subscription fails, the
+// caller resumes from there.
+func (F *Filterer) Subscribe(ctx context.Context, wsUrl string, eventTypes []EventType, startBlock uint64, workers int, handle ChunkHandler) (uint64, error) {
+	next := startBlock
+	client, err := ethclient.DialContext(ctx, wsUrl)
+	if err != nil {
+		return next - 1, err
+	}
+	defer client.Close()
+	heads := make(chan *types.Header, 16)
+	headSub, err := client.SubscribeNewHead(ctx, heads)
+	if err != nil {
+		return next - 1, err
+	}
+	defer headSub.Unsubscribe()
+	slog.Info(fmt.Sprintf("Subscribed to new heads for %v from block %d", eventTypes, startBlock))
+
+	catchUp := func(ctx context.Context, from, to uint64, handle ChunkHandler) (uint64, error) {
+		return F.FilterEventsParallel(ctx, eventTypes, from, to, workers, handle)
+	}
+	filter := func(ctx context.Context, from, to uint64) (Events, error) {
+		client := F.RpcMngr.GetNextRpc()
+		events, _, err := F.filterRange(ctx, client, eventTypes, from, to, F.window(client))
+		return events, err
+	}
+	return follow(ctx, heads, headSub.Err(), startBlock, catchUp, filter, handle)
+}
+
+// rangeCatchUp passes the events of the blocks [from, to] to handle in chunks and
+// returns the last handled block, see FilterEventsParallel
+type rangeCatchUp func(ctx context.Context, from, to uint64, handle ChunkHandler) (uint64, error)
+
+// rangeFilter returns the events of the blocks [from, to]
+type rangeFilter func(ctx context.Context, from, to uint64) (Events, error)
+
+// follow handles the blocks from startBlock on as the heads arrive, see Subscribe
+func follow(ctx context.Context, heads <-chan *types.Header, headErr <-chan error, startBlock uint64, catchUp rangeCatchUp, filter rangeFilter, handle ChunkHandler) (uint64, error) {
+	next := startBlock
+	caughtUp := false
+	for {
+		select {
+		case <-ctx.Done():
+			return next - 1, ctx.Err()
+		case err := <-headErr:
+			return next - 1, fmt.Errorf("head subscription:%w", err)
+		case head := <-heads:
+			headBlock := head.Number.Uint64()
+			metrics.ChainHead.Set(float64(headBlock))
+			if headBlock < next+WS_CONFIRMATIONS {
+				continue
+			}
+			ready := headBlock - WS_CONFIRMATIONS
+			if !caughtUp {
+				// filter the blocks before the subscription in parallel chunks
+				last, err := catchUp(ctx, next, ready, handle)
+				if err != nil {
+					return last, err
+				}
+				next = last + 1
+				caughtUp = last >= ready
+				continue
+			}
+			events, err := filter(ctx, next, ready)
+			if err != nil {
+				return next - 1, err
+			}
+			if err := handle(events, next, ready); err != nil {
+				return next - 1, err
+			}
+			next = ready + 1
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package filterer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// followStub records the ranges passed to the catch-up, the filter and the handler
+type followStub struct {
+	calls    []string
+	rpcHeads []uint64 // the catch-ups stop at these heads of the rpc
+	failAt   uint64   // the handler fails for ranges starting at failAt
+}
+
+func (s *followStub) catchUp(ctx context.Context, from, to uint64, handle ChunkHandler) (uint64, error) {
+	if len(s.rpcHeads) > 0 {
+		to = min(to, s.rpcHeads[0])
+		s.rpcHeads = s.rpcHeads[1:]
+	}
+	s.calls = append(s.calls, fmt.Sprintf("catch-up %d-%d", from, to))
+	return to, nil
+}
+
+func (s *followStub) filter(ctx context.Context, from, to uint64) (Events, error) {
+	s.calls = append(s.calls, fmt.Sprintf("filter %d-%d", from, to))
+	return nil, nil
+}
+
+func (s *followStub) handle(events Events, from, to uint64) error {
+	if from == s.failAt {
+		return errors.New("storing failed")
+	}
+	s.calls = append(s.calls, fmt.Sprintf("handle %d-%d", from, to))
+	return nil
+}
+
+func head(block int64) *types.Header {
+	return &types.Header{Number: big.NewInt(block)}
+}
+
+func TestFollowCatchUpThenHeads(t *testing.T) {
+	s := &followStub{rpcHeads: []uint64{140}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	heads := make(chan *types.Header)
+	type result struct {
+		last uint64
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		last, err := follow(ctx, heads, nil, 100, s.catchUp, s.filter, s.handle)
+		done <- result{last, err}
+	}()
+	// 101 is within WS_CONFIRMATIONS of the start block, the rpc of the first
+	// catch-up is behind the head, 155 is within WS_CONFIRMATIONS of the next block
+	for _, b := range []int64{101, 150, 151, 152, 156, 155} {
+		heads <- head(b)
+	}
+	cancel()
+	res := <-done
+	if !errors.Is(res.err, context.Canceled) || res.last != 154 {
+		t.Fatalf("unexpected result %d, %v", res.last, res.err)
+	}
+	want := []string{
+		"catch-up 100-140",
+		"catch-up 141-149",
+		"filter 150-150", "handle 150-150",
+		"filter 151-154", "handle 151-154",
+	}
+	if !slices.Equal(s.calls, want) {
+		t.Fatalf("unexpected calls %v", s.calls)
+	}
+}
+
+func TestFollowHandlerFailure(t *testing.T) {
+	s := &followStub{failAt: 109}
+	heads := make(chan *types.Header, 2)
+	heads <- head(110)
+	heads <- head(112)
+	last, err := follow(context.Background(), heads, nil, 100, s.catchUp, s.filter, s.handle)
+	if err == nil || last != 108 {
+		t.Fatalf("expected failure with last block 108, got %d, %v", last, err)
+	}
+}
+
+func TestFollowSubscriptionError(t *testing.T) {
+	s := &followStub{}
+	headErr := make(chan error, 1)
+	headErr <- errors.New("connection closed")
+	last, err := follow(context.Background(), nil, headErr, 100, s.catchUp, s.filter, s.handle)
+	if err == nil || last != 99 {
+		t.Fatalf("expected subscription error with last block 99, got %d, %v", last, err)
+	}
+}
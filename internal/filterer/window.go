@@ -0,0 +1,178 @@
+package filterer
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/D8-X/d8x-etherfi/internal/metrics"
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const (
+	// default window sizes in blocks
+	WINDOW_INIT = 10_000
+	WINDOW_MIN  = 100
+	WINDOW_MAX  = 100_000
+	// a window grows after WINDOW_GROW_AFTER successful queries in a row
+	WINDOW_GROW_AFTER = 5
+)
+
+// WindowStore persists the learned window sizes per rpc, the endpoint
+// is the credential-free key of the rpc url (utils.RpcHandler.Key)
+type WindowStore interface {
+	LoadLogWindows() (map[string]uint64, error)
+	StoreLogWindow(endpoint string, size uint64) error
+}
+
+// window is the adaptive number of blocks per log query of an rpc,
+// shared by all workers using the rpc
+type window struct {
+	mu        sync.Mutex
+	size      uint64
+	min       uint64
+	max       uint64
+	successes int
+}
+
+func newWindow(limits utils.RpcLogWindow) *window {
+	w := &window{size: WINDOW_INIT, min: WINDOW_MIN, max: WINDOW_MAX}
+	if limits.Min > 0 {
+		w.min = limits.Min
+	}
+	if limits.Max > 0 {
+		w.max = limits.Max
+	}
+	if limits.Initial > 0 {
+		w.size = limits.Initial
+	}
+	w.max = max(w.max, w.min)
+	w.size = min(max(w.size, w.min), w.max)
+	return w
+}
+
+// get returns the current window size
+func (w *window) get() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// set sets a stored window size within the limits
+func (w *window) set(size uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.size = min(max(size, w.min), w.max)
+}
+
+// shrink halves the window after a query failed because the range or the result
+// was too large. Returns true if the size changed.
+func (w *window) shrink() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	size := w.size
+	w.size = max(w.size/2, w.min)
+	w.successes = 0
+	return w.size != size
+}
+
+// grow doubles the window after WINDOW_GROW_AFTER successful queries.
+// Returns true if the size changed.
+func (w *window) grow() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.successes++
+	if w.successes < WINDOW_GROW_AFTER {
+		return false
+	}
+	size := w.size
+	w.size = min(w.size*2, w.max)
+	w.successes = 0
+	return w.size != size
+}
+
+// SetWindowLimits sets the window limits per rpc url, rpcs without limits use the defaults
+func (F *Filterer) SetWindowLimits(limits map[string]utils.RpcLogWindow) {
+	F.windowMu.Lock()
+	defer F.windowMu.Unlock()
+	F.windows = make(map[*ethclient.Client]*window, len(F.RpcMngr.RpcClients))
+	for _, rpc := range F.RpcMngr.RpcClients {
+		F.windows[rpc] = newWindow(limits[F.RpcMngr.Url(rpc)])
+	}
+}
+
+// SetWindowStore restores the window sizes from the store and persists changes to it
+func (F *Filterer) SetWindowStore(store WindowStore) error {
+	sizes, err := store.LoadLogWindows()
+	if err != nil {
+		return err
+	}
+	for _, rpc := range F.RpcMngr.RpcClients {
+		if size, exists := sizes[F.RpcMngr.Key(rpc)]; exists {
+			F.window(rpc).set(size)
+		}
+	}
+	F.windowMu.Lock()
+	F.store = store
+	F.windowMu.Unlock()
+	return nil
+}
+
+// window returns the window of the rpc
+func (F *Filterer) window(rpc *ethclient.Client) *window {
+	F.windowMu.Lock()
+	defer F.windowMu.Unlock()
+	if F.windows == nil {
+		F.windows = make(map[*ethclient.Client]*window)
+	}
+	w, exists := F.windows[rpc]
+	if !exists {
+		w = newWindow(utils.RpcLogWindow{})
+		F.windows[rpc] = w
+	}
+	return w
+}
+
+// windowChanged reports the window size of the rpc and persists it, if a store is set
+func (F *Filterer) windowChanged(rpc *ethclient.Client, w *window) {
+	metrics.RpcLogWindow.WithLabelValues(F.RpcMngr.Endpoint(rpc)).Set(float64(w.get()))
+	F.windowMu.Lock()
+	store := F.store
+	F.windowMu.Unlock()
+	if store == nil {
+		return
+	}
+	if err := store.StoreLogWindow(F.RpcMngr.Key(rpc), w.get()); err != nil {
+		slog.Error("storing log window:" + err.Error())
+	}
+}
+
+// rangeErrors are the messages of rpc providers rejecting a log query because
+// of the block range or the size of the result
+var rangeErrors = []string{
+	"block range",
+	"blocks range",
+	"range is too large",
+	"range too large",
+	"is limited to",
+	"query returned more than",
+	"too many results",
+	"response size",
+	"exceeds max results",
+}
+
+// isRangeError is true if the rpc rejected a log query because the block range
+// or the number of results is too large
+func isRangeError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	if strings.Contains(msg, "rate limit") || strings.Contains(msg, "too many requests") {
+		return false
+	}
+	for _, s := range rangeErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package filterer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+)
+
+func TestWindow(t *testing.T) {
+	w := newWindow(utils.RpcLogWindow{})
+	w.shrink()
+	if w.get() != WINDOW_INIT/2 {
+		t.Fatalf("unexpected size %d after shrink", w.get())
+	}
+	for k := 0; k < WINDOW_GROW_AFTER; k++ {
+		w.grow()
+	}
+	if w.get() != WINDOW_INIT {
+		t.Fatalf("unexpected size %d after growing", w.get())
+	}
+	for k := 0; k < 20; k++ {
+		w.shrink()
+	}
+	if w.get() != WINDOW_MIN {
+		t.Fatalf("window below minimum %d", w.get())
+	}
+	for k := 0; k < 20*WINDOW_GROW_AFTER; k++ {
+		w.grow()
+	}
+	if w.get() != WINDOW_MAX {
+		t.Fatalf("window above maximum %d", w.get())
+	}
+}
+
+func TestWindowLimits(t *testing.T) {
+	w := newWindow(utils.RpcLogWindow{Initial: 5000, Min: 1000, Max: 8000})
+	if w.get() != 5000 {
+		t.Fatalf("unexpected initial size %d", w.get())
+	}
+	w.set(100_000)
+	if w.get() != 8000 {
+		t.Fatalf("stored size not limited: %d", w.get())
+	}
+	w.shrink()
+	w.shrink()
+	w.shrink()
+	if w.get() != 1000 {
+		t.Fatalf("window below configured minimum %d", w.get())
+	}
+	if w.shrink() {
+		t.Fatalf("shrink at minimum must not change the size")
+	}
+}
+
+func TestIsRangeError(t *testing.T) {
+	for msg, exp := range map[string]bool{
+		"query returned more than 10000 results":          true,
+		"block range is too wide":                         true,
+		"Log response size exceeded":                      true,
+		"429 Too Many Requests: rate limit exceeded":      false,
+		"429 Too Many Requests":                           false,
+		"dial tcp: lookup arb1.arbitrum.io: no such host": false,
+		"context deadline exceeded":                       false,
+		"exceeded the quota usage":                        false,
+		"eth_getLogs is limited to a 10,000 range":        true,
+		"invalid block range params":                      true,
+	} {
+		if isRangeError(errors.New(msg)) != exp {
+			t.Fatalf("isRangeError(%s) != %v", msg, exp)
+		}
+	}
+}
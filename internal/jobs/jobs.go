@@ -0,0 +1,315 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+)
+
+const (
+	STATUS_QUEUED  = "queued"
+	STATUS_RUNNING = "running"
+	STATUS_DONE    = "done"
+	STATUS_FAILED  = "failed"
+
+	// running jobs refresh their heartbeat every HEARTBEAT_INTERVAL
+	HEARTBEAT_INTERVAL = 30 * time.Second
+	// running jobs without heartbeat for JOB_STALE are considered
+	// interrupted (e.g. process crash) and are claimed again
+	JOB_STALE = 4 * HEARTBEAT_INTERVAL
+	// workers look for queued jobs at least every POLL_INTERVAL
+	POLL_INTERVAL = 5 * time.Second
+)
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	ErrQueueFull   = errors.New("too many queued jobs")
+)
+
+// Job is a balance computation that runs in the background.
+// Jobs are persisted in the database so that the status is shared
+// between API replicas and survives restarts.
+type Job struct {
+	Id         string                     `json:"id"`
+	Status     string                     `json:"status"`
+	Request    utils.APIBalancesPayload   `json:"request"`
+	Result     *utils.APIBalancesResponse `json:"result,omitempty"`
+	Error      string                     `json:"error,omitempty"`
+	CreatedOn  time.Time                  `json:"createdOn"`
+	StartedOn  *time.Time                 `json:"startedOn,omitempty"`
+	FinishedOn *time.Time                 `json:"finishedOn,omitempty"`
+	ExpiresOn  *time.Time                 `json:"expiresOn,omitempty"`
+}
+
+// Manager runs balance jobs with a pool of workers
+type Manager struct {
+	db        *sql.DB
+	chainId   int64
+	compute   func(context.Context, utils.APIBalancesPayload) (utils.APIBalancesResponse, error)
+	workers   int
+	maxQueued int
+	retention time.Duration
+	wakeup    chan struct{}
+	running   sync.WaitGroup
+}
+
+func NewManager(db *sql.DB, chainId int64, compute func(context.Context, utils.APIBalancesPayload) (utils.APIBalancesResponse, error), workers, maxQueued int, retention time.Duration) *Manager {
+	return &Manager{
+		db:        db,
+		chainId:   chainId,
+		compute:   compute,
+		workers:   workers,
+		maxQueued: maxQueued,
+		retention: retention,
+		wakeup:    make(chan struct{}, workers),
+	}
+}
+
+// Start starts the workers and the removal of expired jobs. Workers
+// stop taking new jobs when ctx is canceled, jobs interrupted by the
+// cancellation are queued again.
+func (m *Manager) Start(ctx context.Context) {
+	slog.Info(fmt.Sprintf("starting %d job workers, job retention %s", m.workers, m.retention))
+	for k := 0; k < m.workers; k++ {
+		m.running.Add(1)
+		go m.work(ctx)
+	}
+	go m.expire(ctx)
+}
+
+// Wait waits until all workers stopped
+func (m *Manager) Wait() {
+	m.running.Wait()
+}
+
+// Submit queues a balance job
+func (m *Manager) Submit(req utils.APIBalancesPayload) (Job, error) {
+	var queued int
+	query := `SELECT count(*) FROM balance_job WHERE chain_id=$1 AND status=$2`
+	err := m.db.QueryRow(query, m.chainId, STATUS_QUEUED).Scan(&queued)
+	if err != nil {
+		return Job{}, errors.New("Submit:" + err.Error())
+	}
+	if queued >= m.maxQueued {
+		return Job{}, ErrQueueFull
+	}
+	id, err := newId()
+	if err != nil {
+		return Job{}, err
+	}
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return Job{}, err
+	}
+	job := Job{Id: id, Status: STATUS_QUEUED, Request: req}
+	query = `INSERT INTO balance_job(id, chain_id, status, request) VALUES($1, $2, $3, $4) RETURNING created_on`
+	err = m.db.QueryRow(query, id, m.chainId, STATUS_QUEUED, payload).Scan(&job.CreatedOn)
+	if err != nil {
+		return Job{}, errors.New("Submit:" + err.Error())
+	}
+	select {
+	case m.wakeup <- struct{}{}:
+	default:
+		// all workers busy, the job is picked up by polling
+	}
+	slog.Info("queued balance job " + id)
+	return job, nil
+}
+
+// Get returns the job with the given id. Expired jobs are not found.
+func (m *Manager) Get(id string) (Job, error) {
+	query := `SELECT status, request, result, error, created_on, started_on, finished_on
+		FROM balance_job WHERE id=$1 AND chain_id=$2`
+	var job Job
+	var request, result []byte
+	var errMsg sql.NullString
+	var started, finished sql.NullTime
+	err := m.db.QueryRow(query, id, m.chainId).Scan(&job.Status, &request, &result, &errMsg, &job.CreatedOn, &started, &finished)
+	if err == sql.ErrNoRows {
+		return Job{}, ErrJobNotFound
+	}
+	if err != nil {
+		return Job{}, errors.New("Get:" + err.Error())
+	}
+	job.Id = id
+	job.Error = errMsg.String
+	if err := json.Unmarshal(request, &job.Request); err != nil {
+		return Job{}, err
+	}
+	if result != nil {
+		job.Result = new(utils.APIBalancesResponse)
+		if err := json.Unmarshal(result, job.Result); err != nil {
+			return Job{}, err
+		}
+	}
+	if started.Valid {
+		job.StartedOn = &started.Time
+	}
+	if finished.Valid {
+		job.FinishedOn = &finished.Time
+		expires := finished.Time.Add(m.retention)
+		if time.Now().After(expires) {
+			return Job{}, ErrJobNotFound
+		}
+		job.ExpiresOn = &expires
+	}
+	return job, nil
+}
+
+// work runs queued jobs one at a time
+func (m *Manager) work(ctx context.Context) {
+	defer m.running.Done()
+	for {
+		for ctx.Err() == nil {
+			claimed, err := m.runNext(ctx)
+			if err != nil {
+				slog.Error("job worker:" + err.Error())
+			}
+			if !claimed {
+				break
+			}
+		}
+		select {
+		case <-m.wakeup:
+		case <-time.After(POLL_INTERVAL):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runNext claims the oldest queued job and runs it. Returns false
+// if there was no job to run.
+func (m *Manager) runNext(ctx context.Context) (bool, error) {
+	// SKIP LOCKED ensures that each job is claimed by one worker only,
+	// also across replicas. Jobs from before the heartbeat was introduced
+	// fall back to started_on.
+	query := `UPDATE balance_job SET status=$1, started_on=now(), heartbeat_on=now()
+		WHERE id = (
+			SELECT id FROM balance_job
+			WHERE chain_id=$2 AND (status=$3 OR
+				(status=$1 AND COALESCE(heartbeat_on, started_on) < now() - $4::interval))
+			ORDER BY created_on LIMIT 1 FOR UPDATE SKIP LOCKED)
+		RETURNING id, request`
+	var id string
+	var request []byte
+	stale := fmt.Sprintf("%d seconds", int(JOB_STALE.Seconds()))
+	err := m.db.QueryRowContext(ctx, query, STATUS_RUNNING, m.chainId, STATUS_QUEUED, stale).Scan(&id, &request)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var req utils.APIBalancesPayload
+	if err := json.Unmarshal(request, &req); err != nil {
+		return true, m.finish(id, nil, err)
+	}
+	slog.Info("running balance job " + id)
+	time0 := time.Now()
+	stop := m.heartbeat(id)
+	res, err := m.compute(ctx, req)
+	stop()
+	if err != nil && ctx.Err() != nil {
+		// shutdown, another worker takes over
+		slog.Info("balance job " + id + " interrupted, queued again")
+		return false, m.requeue(id)
+	}
+	if errors.Is(err, utils.ErrOverloaded) {
+		// put the job back into the queue and retry later
+		slog.Info("balance job " + id + " postponed: " + err.Error())
+		return false, m.requeue(id)
+	}
+	if err != nil {
+		slog.Error("balance job " + id + " failed:" + err.Error())
+		return true, m.finish(id, nil, err)
+	}
+	slog.Info(fmt.Sprintf("balance job %s completed in %s", id, time.Since(time0)))
+	return true, m.finish(id, &res, nil)
+}
+
+// heartbeat periodically marks the running job as alive until the
+// returned stop function is called
+func (m *Manager) heartbeat(id string) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		tick := time.NewTicker(HEARTBEAT_INTERVAL)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				query := `UPDATE balance_job SET heartbeat_on=now() WHERE id=$1 AND status=$2`
+				if _, err := m.db.Exec(query, id, STATUS_RUNNING); err != nil {
+					slog.Error("heartbeat of balance job " + id + ":" + err.Error())
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// requeue puts a claimed job back into the queue
+func (m *Manager) requeue(id string) error {
+	query := `UPDATE balance_job SET status=$1, started_on=NULL, heartbeat_on=NULL WHERE id=$2`
+	_, err := m.db.Exec(query, STATUS_QUEUED, id)
+	return err
+}
+
+// finish stores the result or error of the job
+func (m *Manager) finish(id string, res *utils.APIBalancesResponse, jobErr error) error {
+	if jobErr != nil {
+		query := `UPDATE balance_job SET status=$1, error=$2, finished_on=now() WHERE id=$3`
+		_, err := m.db.Exec(query, STATUS_FAILED, jobErr.Error(), id)
+		return err
+	}
+	result, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE balance_job SET status=$1, result=$2, finished_on=now() WHERE id=$3`
+	_, err = m.db.Exec(query, STATUS_DONE, result, id)
+	return err
+}
+
+// expire periodically removes completed jobs after the retention period
+func (m *Manager) expire(ctx context.Context) {
+	for {
+		query := `DELETE FROM balance_job WHERE chain_id=$1 AND status IN ($2, $3) AND finished_on < now() - $4::interval`
+		retention := fmt.Sprintf("%d seconds", int(m.retention.Seconds()))
+		res, err := m.db.Exec(query, m.chainId, STATUS_DONE, STATUS_FAILED, retention)
+		if err != nil {
+			slog.Error("removing expired jobs:" + err.Error())
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			slog.Info(fmt.Sprintf("removed %d expired jobs", n))
+		}
+		select {
+		case <-time.After(time.Minute):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func newId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,159 @@
+package leader
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/D8-X/d8x-etherfi/internal/metrics"
+)
+
+const (
+	// LOCK_CLASS is the first key of the advisory lock, the second key
+	// is the chain id
+	LOCK_CLASS = 0x0d8e7f1
+	// followers try to acquire the lock every RETRY_INTERVAL
+	RETRY_INTERVAL = 10 * time.Second
+	// the leader checks its database session every HEARTBEAT_INTERVAL
+	HEARTBEAT_INTERVAL = 5 * time.Second
+)
+
+var ErrNotLeader = errors.New("not the indexer leader")
+
+// Elector elects one leader among all instances using a Postgres advisory
+// lock. The lock is bound to a dedicated database session, so it is released
+// when the leader dies or loses its connection and another instance takes over.
+// Each new leader increments the epoch in table indexer_leader, which fences
+// the transactions of former leaders.
+type Elector struct {
+	db        *sql.DB
+	chainId   int32
+	heartbeat time.Duration
+	mu        sync.RWMutex
+	epoch     int64 // epoch of the leadership, 0 if not leader
+}
+
+func NewElector(db *sql.DB, chainId int64) *Elector {
+	return &Elector{db: db, chainId: int32(chainId), heartbeat: HEARTBEAT_INTERVAL}
+}
+
+// Run calls lead whenever this instance becomes leader. The context passed to
+// lead is canceled when the leadership is lost. Returns when ctx is canceled.
+func (e *Elector) Run(ctx context.Context, lead func(context.Context)) {
+	for ctx.Err() == nil {
+		conn, acquired, err := e.tryAcquire(ctx)
+		if err != nil {
+			slog.Error("leader election:" + err.Error())
+		}
+		if acquired {
+			e.lead(ctx, conn.PingContext, func() { e.release(conn) }, lead)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(RETRY_INTERVAL):
+		}
+	}
+}
+
+// IsLeader returns true if this instance currently holds the lock
+func (e *Elector) IsLeader() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.epoch != 0
+}
+
+// Fence fails with ErrNotLeader unless the epoch of this instance is the current epoch.
+// Called within the transactions of the leader: the epoch row stays share-locked until
+// the transaction ends and a new leader increments the epoch only after that, so that an
+// instance that lost the lock cannot write after another instance took over.
+func (e *Elector) Fence(tx *sql.Tx) error {
+	e.mu.RLock()
+	epoch := e.epoch
+	e.mu.RUnlock()
+	if epoch == 0 {
+		return ErrNotLeader
+	}
+	var current int64
+	query := `SELECT epoch FROM indexer_leader WHERE chain_id=$1 FOR SHARE`
+	err := tx.QueryRow(query, e.chainId).Scan(&current)
+	if err == sql.ErrNoRows || (err == nil && current != epoch) {
+		return ErrNotLeader
+	}
+	return err
+}
+
+// tryAcquire tries to obtain the lock on a dedicated connection and starts a new
+// epoch. Waits for the transactions of the former leader to end.
+func (e *Elector) tryAcquire(ctx context.Context) (*sql.Conn, bool, error) {
+	conn, err := e.db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	var acquired bool
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1, $2)`, LOCK_CLASS, e.chainId).Scan(&acquired)
+	if err != nil || !acquired {
+		conn.Close()
+		return nil, false, err
+	}
+	var epoch int64
+	query := `INSERT INTO indexer_leader(chain_id, epoch) VALUES($1, 1)
+		ON CONFLICT (chain_id) DO UPDATE SET epoch=indexer_leader.epoch+1, updated_on=CURRENT_TIMESTAMP
+		RETURNING epoch`
+	if err := conn.QueryRowContext(ctx, query, e.chainId).Scan(&epoch); err != nil {
+		e.release(conn)
+		return nil, false, err
+	}
+	e.mu.Lock()
+	e.epoch = epoch
+	e.mu.Unlock()
+	return conn, true, nil
+}
+
+// lead runs lead until ctx is canceled or ping of the session holding the lock
+// fails, then releases the session
+func (e *Elector) lead(ctx context.Context, ping func(context.Context) error, release func(), lead func(context.Context)) {
+	slog.Info(fmt.Sprintf("became indexer leader for chain %d, epoch %d", e.chainId, e.epoch))
+	metrics.IndexerLeader.Set(1)
+	leaderCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lead(leaderCtx)
+	}()
+	for leaderCtx.Err() == nil {
+		select {
+		case <-done:
+			cancel()
+		case <-time.After(e.heartbeat):
+			pingCtx, cancelPing := context.WithTimeout(ctx, e.heartbeat)
+			err := ping(pingCtx)
+			cancelPing()
+			if err != nil && ctx.Err() == nil {
+				slog.Error("lost indexer leadership:" + err.Error())
+				cancel()
+			}
+		}
+	}
+	// the fence rejects writes from here on
+	e.mu.Lock()
+	e.epoch = 0
+	e.mu.Unlock()
+	<-done
+	cancel()
+	metrics.IndexerLeader.Set(0)
+	release()
+	slog.Info("stepped down as indexer leader")
+}
+
+// release unlocks and returns the connection. If the session is broken,
+// the lock is released by Postgres.
+func (e *Elector) release(conn *sql.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), HEARTBEAT_INTERVAL)
+	defer cancel()
+	conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1, $2)`, LOCK_CLASS, e.chainId)
+	conn.Close()
+}
@@ -0,0 +1,140 @@
+package leader
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/D8-X/d8x-etherfi/internal/db"
+)
+
+func TestFenceNotLeader(t *testing.T) {
+	e := NewElector(nil, 42161)
+	if e.IsLeader() {
+		t.Fatalf("new elector must not be leader")
+	}
+	if err := e.Fence(nil); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("expected ErrNotLeader, got %v", err)
+	}
+}
+
+func TestLeadStepsDownOnFailedPing(t *testing.T) {
+	e := NewElector(nil, 42161)
+	e.heartbeat = 10 * time.Millisecond
+	// as after tryAcquire
+	e.epoch = 1
+	var pings atomic.Int32
+	ping := func(ctx context.Context) error {
+		if pings.Add(1) > 2 {
+			return errors.New("connection reset")
+		}
+		return nil
+	}
+	var released bool
+	var wasLeader, stopped bool
+	lead := func(ctx context.Context) {
+		wasLeader = e.IsLeader()
+		// the indexer runs until the leadership is lost
+		select {
+		case <-ctx.Done():
+			stopped = true
+		case <-time.After(5 * time.Second):
+		}
+	}
+	e.lead(context.Background(), ping, func() { released = true }, lead)
+	if !wasLeader || !stopped {
+		t.Fatalf("lead not canceled after failed ping (leader %v, stopped %v)", wasLeader, stopped)
+	}
+	if !released || e.IsLeader() {
+		t.Fatalf("leadership not released")
+	}
+	if err := e.Fence(nil); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("fence after lost lock: expected ErrNotLeader, got %v", err)
+	}
+}
+
+func TestLeadReturns(t *testing.T) {
+	e := NewElector(nil, 42161)
+	e.epoch = 1
+	var released bool
+	time0 := time.Now()
+	e.lead(context.Background(), func(context.Context) error { return nil }, func() { released = true }, func(context.Context) {})
+	if !released || e.IsLeader() || time.Since(time0) > e.heartbeat {
+		t.Fatalf("no step-down after lead returned")
+	}
+}
+
+func TestFenceHoldsUntilCommit(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN not set")
+	}
+	if err := db.Migrate(dsn); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	const chainId = 999_001
+	defer conn.Exec(`DELETE FROM indexer_leader WHERE chain_id=$1`, chainId)
+	ctx := context.Background()
+
+	former := NewElector(conn, chainId)
+	formerConn, acquired, err := former.tryAcquire(ctx)
+	if err != nil || !acquired {
+		t.Fatalf("lock not acquired: %v", err)
+	}
+	tx, err := conn.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := former.Fence(tx); err != nil {
+		t.Fatal(err)
+	}
+	// the session holding the lock dies while the index transaction is open
+	former.release(formerConn)
+	next := NewElector(conn, chainId)
+	type result struct {
+		conn     *sql.Conn
+		acquired bool
+		err      error
+	}
+	took := make(chan result, 1)
+	go func() {
+		c, acquired, err := next.tryAcquire(ctx)
+		took <- result{c, acquired, err}
+	}()
+	select {
+	case <-took:
+		t.Fatal("took over while the transaction of the former leader is open")
+	case <-time.After(500 * time.Millisecond):
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("transaction of the former leader: %v", err)
+	}
+	res := <-took
+	if res.err != nil || !res.acquired {
+		t.Fatalf("lock not acquired after commit: %v", res.err)
+	}
+	defer next.release(res.conn)
+
+	// the former leader has not noticed the loss yet
+	tx, err = conn.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := former.Fence(tx); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("fence of former leader: expected ErrNotLeader, got %v", err)
+	}
+	if err := next.Fence(tx); err != nil {
+		t.Fatalf("fence of new leader: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package merkle
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Tree is a binary Merkle tree with sorted-pair hashing. The encoding is
+// compatible with OpenZeppelin's MerkleProof.verify:
+//   - leaf = keccak256(keccak256(abi.encode(address account, uint256 amount)))
+//   - leaves are sorted ascending by their hash before building the tree
+//   - inner node = keccak256(min(a,b) ++ max(a,b))
+//   - a node without sibling is promoted to the next layer unchanged
+type Tree struct {
+	layers [][]common.Hash
+}
+
+// LeafHash calculates the leaf hash for an (address, amount) pair
+func LeafHash(addr common.Address, amount *big.Int) common.Hash {
+	enc := make([]byte, 0, 64)
+	enc = append(enc, common.LeftPadBytes(addr.Bytes(), 32)...)
+	enc = append(enc, common.LeftPadBytes(amount.Bytes(), 32)...)
+	return crypto.Keccak256Hash(crypto.Keccak256(enc))
+}
+
+// NewTree builds a tree from the given leaf hashes. The input slice
+// is not modified
+func NewTree(leaves []common.Hash) *Tree {
+	layer := make([]common.Hash, len(leaves))
+	copy(layer, leaves)
+	sort.Slice(layer, func(i, j int) bool {
+		return bytes.Compare(layer[i][:], layer[j][:]) < 0
+	})
+	t := Tree{layers: [][]common.Hash{layer}}
+	for len(layer) > 1 {
+		next := make([]common.Hash, 0, (len(layer)+1)/2)
+		for k := 0; k < len(layer); k += 2 {
+			if k+1 == len(layer) {
+				next = append(next, layer[k])
+				continue
+			}
+			next = append(next, hashPair(layer[k], layer[k+1]))
+		}
+		t.layers = append(t.layers, next)
+		layer = next
+	}
+	return &t
+}
+
+// Root returns the Merkle root, the zero hash for an empty tree
+func (t *Tree) Root() common.Hash {
+	top := t.layers[len(t.layers)-1]
+	if len(top) == 0 {
+		return common.Hash{}
+	}
+	return top[0]
+}
+
+// Proof returns the sibling path from the given leaf to the root
+func (t *Tree) Proof(leaf common.Hash) ([]common.Hash, error) {
+	idx := -1
+	for k, l := range t.layers[0] {
+		if l == leaf {
+			idx = k
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, errors.New("leaf not in tree")
+	}
+	proof := make([]common.Hash, 0, len(t.layers))
+	for _, layer := range t.layers[:len(t.layers)-1] {
+		sibling := idx ^ 1
+		if sibling < len(layer) {
+			proof = append(proof, layer[sibling])
+		}
+		idx /= 2
+	}
+	return proof, nil
+}
+
+// Verify checks that the leaf is part of the tree with the given root
+func Verify(proof []common.Hash, root, leaf common.Hash) bool {
+	h := leaf
+	for _, p := range proof {
+		h = hashPair(h, p)
+	}
+	return h == root
+}
+
+func hashPair(a, b common.Hash) common.Hash {
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+	return crypto.Keccak256Hash(a[:], b[:])
+}
@@ -0,0 +1,40 @@
+package merkle
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestTreeProofs(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		leaves := make([]common.Hash, 0, n)
+		for k := 0; k < n; k++ {
+			addr := common.BigToAddress(big.NewInt(int64(k + 1)))
+			leaves = append(leaves, LeafHash(addr, big.NewInt(int64(1000*(k+1)))))
+		}
+		tree := NewTree(leaves)
+		root := tree.Root()
+		for _, leaf := range leaves {
+			proof, err := tree.Proof(leaf)
+			if err != nil {
+				t.Fatalf("n=%d: %v", n, err)
+			}
+			if !Verify(proof, root, leaf) {
+				t.Fatalf("n=%d: proof does not verify", n)
+			}
+		}
+		other := LeafHash(common.Address{}, big.NewInt(1))
+		if _, err := tree.Proof(other); err == nil {
+			t.Fatalf("n=%d: expected error for unknown leaf", n)
+		}
+	}
+}
+
+func TestEmptyTree(t *testing.T) {
+	tree := NewTree(nil)
+	if tree.Root() != (common.Hash{}) {
+		t.Fatal("expected zero root for empty tree")
+	}
+}
@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const NAMESPACE = "etherfi"
+
+var (
+	IndexedBlock = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "indexed_block",
+		Help:      "Latest block up to which events are indexed",
+	}, []string{"event"})
+	ChainHead = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "chain_head_block",
+		Help:      "Latest block of the chain seen by the event filterer",
+	})
+	EventsIngested = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "events_ingested_total",
+		Help:      "Number of events stored in the database",
+	}, []string{"event"})
+	LogsSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "logs_skipped_total",
+		Help:      "Number of logs skipped because they could not be decoded",
+	}, []string{"event"})
+	RpcCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "rpc_calls_total",
+		Help:      "Number of RPC calls per endpoint",
+	}, []string{"endpoint"})
+	RpcErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "rpc_errors_total",
+		Help:      "Number of failed RPC calls per endpoint",
+	}, []string{"endpoint"})
+	RpcRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "rpc_retries_total",
+		Help:      "Number of retried RPC calls per endpoint",
+	}, []string{"endpoint"})
+	RpcLogWindow = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "rpc_log_window_blocks",
+		Help:      "Learned number of blocks per log query",
+	}, []string{"endpoint"})
+	TokenWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "rpc_token_wait_seconds",
+		Help:      "Time waited for a token of the RPC rate limit",
+		Buckets:   []float64{0.001, 0.01, 0.1, 0.5, 1, 2, 5, 10},
+	}, []string{"endpoint"})
+	BalancesDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "balances_duration_seconds",
+		Help:      "Duration of balance computations",
+		Buckets:   []float64{0.1, 0.5, 1, 2, 5, 10, 30, 60, 120, 300},
+	})
+	Holders = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "holders",
+		Help:      "Number of addresses with non-zero balance at the latest precomputed block",
+	})
+	IndexerLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "indexer_leader",
+		Help:      "1 if this instance is the indexer leader",
+	})
+	HttpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests per route",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+)
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware records the latency of HTTP requests per route pattern
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time0 := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		code := ww.Status()
+		if code == 0 {
+			code = http.StatusOK
+		}
+		HttpDuration.WithLabelValues(route, r.Method, strconv.Itoa(code)).Observe(time.Since(time0).Seconds())
+	})
+}
+
+// Endpoint returns the label of an RPC url. Only the host is used since
+// paths and queries of RPC urls often contain API keys.
+func Endpoint(rpcUrl string) string {
+	u, err := url.Parse(rpcUrl)
+	if err != nil || u.Host == "" {
+		return "unknown"
+	}
+	return u.Host
+}
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEndpoint(t *testing.T) {
+	if e := Endpoint("https://arb-mainnet.g.alchemy.com/v2/secretkey"); e != "arb-mainnet.g.alchemy.com" {
+		t.Fatalf("unexpected endpoint %s", e)
+	}
+	if e := Endpoint("not a url"); e != "unknown" {
+		t.Fatalf("unexpected endpoint %s", e)
+	}
+}
+
+func TestMiddlewareRoutePattern(t *testing.T) {
+	router := chi.NewRouter()
+	router.Use(Middleware)
+	router.Get("/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/jobs/abc", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/jobs/def", nil))
+	n := testutil.CollectAndCount(HttpDuration)
+	if n != 1 {
+		t.Fatalf("expected one series for the route pattern, got %d", n)
+	}
+}
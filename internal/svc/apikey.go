@@ -0,0 +1,86 @@
+package svc
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/D8-X/d8x-etherfi/internal/auth"
+	"github.com/D8-X/d8x-etherfi/internal/env"
+)
+
+// ApiKeyCmd runs the admin commands to manage API keys stored in the database:
+//
+//	apikey create -name <name> [-capacity 10] [-rate 2]
+//	apikey revoke -name <name>
+//	apikey list
+func ApiKeyCmd(args []string) {
+	if len(args) == 0 {
+		fmt.Println("usage: apikey create|revoke|list [flags]")
+		os.Exit(2)
+	}
+	v, err := loadEnv(env.DATABASE_DSN)
+	if err != nil {
+		slog.Error("Error:" + err.Error())
+		os.Exit(1)
+	}
+	db, err := sql.Open("postgres", v.GetString(env.DATABASE_DSN))
+	if err != nil {
+		slog.Error("connecting to db", "error", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+	if err := runMigrations(v.GetString(env.DATABASE_DSN)); err != nil {
+		slog.Error("running migrations", "error", err)
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("apikey "+args[0], flag.ExitOnError)
+	name := fs.String("name", "", "name of the key owner")
+	capacity := fs.Int("capacity", 10, "burst capacity of the rate limit")
+	rate := fs.Float64("rate", 2, "requests per second")
+	fs.Parse(args[1:])
+
+	switch args[0] {
+	case "create":
+		key, err := auth.CreateKey(db, *name, *capacity, *rate)
+		if err != nil {
+			slog.Error("creating key", "error", err)
+			os.Exit(1)
+		}
+		fmt.Printf("created key for %s (store it, it cannot be shown again):\n%s\n", *name, key)
+	case "revoke":
+		if err := auth.RevokeKey(db, *name); err != nil {
+			slog.Error("revoking key", "error", err)
+			os.Exit(1)
+		}
+		fmt.Printf("revoked key of %s\n", *name)
+	case "list":
+		keys, err := auth.ListKeys(db)
+		if err != nil {
+			slog.Error("listing keys", "error", err)
+			os.Exit(1)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tCAPACITY\tRATE\tUSAGE\tLAST USED\tCREATED\tREVOKED")
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s\t%d\t%g\t%d\t%s\t%s\t%s\n", k.Name, k.Capacity, k.RefillRate, k.Usage,
+				fmtTime(k.LastUsedOn), k.CreatedOn.Format(time.RFC3339), fmtTime(k.RevokedOn))
+		}
+		w.Flush()
+	default:
+		fmt.Println("unknown command apikey " + args[0])
+		os.Exit(2)
+	}
+}
+
+func fmtTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
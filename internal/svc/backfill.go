@@ -0,0 +1,64 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/D8-X/d8x-etherfi/internal/env"
+	"github.com/D8-X/d8x-etherfi/internal/etherfi"
+)
+
+// backfillEvents maps the names of the -events flag to the event types
+var backfillEvents = map[string]string{
+	"transfers":    etherfi.EVENT_TRANSFER,
+	"delegates":    etherfi.EVENT_DELEGATE,
+	"trades":       etherfi.EVENT_TRADE,
+	"deposits":     etherfi.EVENT_DEPOSIT,
+	"withdrawals":  etherfi.EVENT_WITHDRAW,
+	"liquidations": etherfi.EVENT_LIQUIDATION,
+	"settlements":  etherfi.EVENT_SETTLEMENT,
+}
+
+// EVENT_NAMES lists the names of the -events flag
+const EVENT_NAMES = "transfers, delegates, trades, deposits, withdrawals, liquidations, settlements"
+
+// runBackfill re-indexes the events of a block range
+func runBackfill(args []string) error {
+	v, _ := loadEnv()
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	var opts etherfi.BackfillOptions
+	fs.Uint64Var(&opts.From, "from", 0, "first block to re-index")
+	fs.Uint64Var(&opts.To, "to", 0, "last block to re-index, at most the indexed block")
+	events := fs.String("events", "transfers,delegates", "comma separated event types: "+EVENT_NAMES)
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "report the events found and the rows stored, without writing")
+	fs.BoolVar(&opts.Resume, "resume", true, "continue an interrupted run with the same parameters")
+	fs.BoolVar(&opts.Shadow, "shadow", false, "rebuild into shadow tables that replace the tables when done (indexer must be stopped for the swap)")
+	doMigrate := fs.Bool("migrate", true, "run the database migrations on startup")
+	fs.Parse(args)
+	if err := requireEnv(v, env.CONFIG_PATH, env.DATABASE_DSN); err != nil {
+		return err
+	}
+	if opts.From == 0 || opts.To == 0 {
+		return errors.New("-from and -to required")
+	}
+	for _, name := range strings.Split(*events, ",") {
+		event, exists := backfillEvents[strings.TrimSpace(name)]
+		if !exists {
+			return fmt.Errorf("unknown event type %s, use %s", name, EVENT_NAMES)
+		}
+		opts.Events = append(opts.Events, event)
+	}
+	app, err := newApp(v, *doMigrate)
+	if err != nil {
+		return err
+	}
+	defer app.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	return app.Backfill(ctx, opts)
+}
@@ -0,0 +1,73 @@
+package svc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/D8-X/d8x-etherfi/internal/env"
+	"github.com/D8-X/d8x-etherfi/internal/utils"
+)
+
+// runCheckRanges reports the gaps and overlaps in the indexed ranges and
+// optionally re-indexes them. Fails if gaps or overlaps remain.
+func runCheckRanges(args []string) error {
+	v, _ := loadEnv()
+	fs := flag.NewFlagSet("check-ranges", flag.ExitOnError)
+	events := fs.String("events", "transfers,delegates", "comma separated event types: "+EVENT_NAMES)
+	repair := fs.Bool("repair", false, "re-index the gaps and overlaps")
+	doMigrate := fs.Bool("migrate", true, "run the database migrations on startup")
+	fs.Parse(args)
+	if err := requireEnv(v, env.CONFIG_PATH, env.DATABASE_DSN); err != nil {
+		return err
+	}
+	var eventTypes []string
+	for _, name := range strings.Split(*events, ",") {
+		event, exists := backfillEvents[strings.TrimSpace(name)]
+		if !exists {
+			return fmt.Errorf("unknown event type %s, use %s", name, EVENT_NAMES)
+		}
+		eventTypes = append(eventTypes, event)
+	}
+	app, err := newApp(v, *doMigrate)
+	if err != nil {
+		return err
+	}
+	defer app.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	checks := make([]utils.RangeCheck, 0, len(eventTypes))
+	var incomplete bool
+	for _, event := range eventTypes {
+		check, err := app.CheckRanges(event)
+		if err != nil {
+			return err
+		}
+		if *repair && (len(check.Gaps) > 0 || len(check.Overlaps) > 0) {
+			if _, err := app.RepairRanges(ctx, check, 0); err != nil {
+				return err
+			}
+			if check, err = app.CheckRanges(event); err != nil {
+				return err
+			}
+		}
+		incomplete = incomplete || len(check.Gaps) > 0 || len(check.Overlaps) > 0
+		checks = append(checks, check)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(checks); err != nil {
+		return err
+	}
+	if incomplete {
+		return errors.New("indexed ranges have gaps or overlaps")
+	}
+	return nil
+}
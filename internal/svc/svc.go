@@ -1,17 +1,24 @@
 package svc
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/D8-X/d8x-etherfi/internal/api"
+	"github.com/D8-X/d8x-etherfi/internal/auth"
 	"github.com/D8-X/d8x-etherfi/internal/db"
 	"github.com/D8-X/d8x-etherfi/internal/env"
 	"github.com/D8-X/d8x-etherfi/internal/etherfi"
-	"github.com/golang-migrate/migrate/v4"
-	_ "github.com/golang-migrate/migrate/v4/database/postgres"
-	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/D8-X/d8x-etherfi/internal/leader"
 	"github.com/spf13/viper"
 )
 
@@ -21,16 +28,222 @@ func init() {
 	})))
 }
 
-func Run() {
-	v, err := loadEnv()
+const USAGE = `usage: app <command> [flags]
+
+commands:
+  all           run migrations, the indexer and the API (default)
+  serve-api     serve the API, reads the events indexed by another process
+  index         index events if elected leader, optionally serve metrics and probes
+  migrate       run the database migrations and exit
+  backfill      re-index the events of a block range
+  check-ranges  report (and repair) gaps and overlaps in the indexed block ranges
+  apikey        manage API keys (create|revoke|list)
+
+run app <command> -h for the flags of a command`
+
+// Main runs the command given by args (without program name)
+func Main(args []string) {
+	cmd := "all"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	var err error
+	switch cmd {
+	case "all":
+		err = runAll(args)
+	case "serve-api":
+		err = runServeApi(args)
+	case "index":
+		err = runIndex(args)
+	case "migrate":
+		err = runMigrate(args)
+	case "backfill":
+		err = runBackfill(args)
+	case "check-ranges":
+		err = runCheckRanges(args)
+	case "apikey":
+		ApiKeyCmd(args)
+	case "help", "-h", "--help":
+		fmt.Println(USAGE)
+	default:
+		fmt.Println(USAGE)
+		os.Exit(2)
+	}
 	if err != nil {
 		slog.Error("Error:" + err.Error())
-		return
+		os.Exit(1)
+	}
+}
+
+// apiFlags are the flags of commands that serve the API
+type apiFlags struct {
+	bind     string
+	port     string
+	auth     string
+	keysFile string
+}
+
+func (f *apiFlags) register(fs *flag.FlagSet, v *viper.Viper) {
+	fs.StringVar(&f.bind, "bind", v.GetString(env.API_BIND_ADDR), "address the API binds to (env "+env.API_BIND_ADDR+")")
+	fs.StringVar(&f.port, "port", v.GetString(env.API_PORT), "API port (env "+env.API_PORT+")")
+	fs.StringVar(&f.auth, "auth", v.GetString(env.API_AUTH), "API key authentication: db, file or empty for an open API (env "+env.API_AUTH+")")
+	fs.StringVar(&f.keysFile, "keys-file", v.GetString(env.API_KEYS_FILE), "API key file for -auth file (env "+env.API_KEYS_FILE+")")
+}
+
+func (f *apiFlags) validate() error {
+	if f.port == "" {
+		return fmt.Errorf("API port required, set -port or %s", env.API_PORT)
+	}
+	return nil
+}
+
+// runAll runs migrations, the indexer and the API in one process
+func runAll(args []string) error {
+	v, _ := loadEnv()
+	fs := flag.NewFlagSet("all", flag.ExitOnError)
+	var af apiFlags
+	af.register(fs, v)
+	fs.Parse(args)
+	if err := requireEnv(v, env.CONFIG_PATH, env.DATABASE_DSN); err != nil {
+		return err
+	}
+	if err := af.validate(); err != nil {
+		return err
+	}
+	app, err := newApp(v, true)
+	if err != nil {
+		return err
+	}
+	authn, err := newAuthenticator(af.auth, af.keysFile, app)
+	if err != nil {
+		return errors.New("loading api keys:" + err.Error())
 	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// only one replica indexes, the others take over when it fails
+	app.Leader = leader.NewElector(app.Db, app.Config.ChainId)
+	var wg sync.WaitGroup
+	// start go routine to periodically filter for events
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		app.RunIndexer(ctx)
+	}()
+	app.StartJobs(ctx)
+
+	err = api.StartApiServer(ctx, app, authn, af.bind, af.port)
+	if err != nil {
+		slog.Error(err.Error())
+	}
+	// the api server returns when ctx is canceled or the server failed
+	stop()
+	shutdown(app, authn, &wg)
+	return nil
+}
+
+// runServeApi serves the API. Events are indexed by another process (index) into
+// the shared database, so that several stateless API replicas can run.
+func runServeApi(args []string) error {
+	v, _ := loadEnv()
+	fs := flag.NewFlagSet("serve-api", flag.ExitOnError)
+	var af apiFlags
+	af.register(fs, v)
+	jobs := fs.Bool("jobs", true, "run workers for asynchronous balance jobs")
+	doMigrate := fs.Bool("migrate", false, "run the database migrations on startup")
+	fs.Parse(args)
+	if err := requireEnv(v, env.CONFIG_PATH, env.DATABASE_DSN); err != nil {
+		return err
+	}
+	if err := af.validate(); err != nil {
+		return err
+	}
+	app, err := newApp(v, *doMigrate)
+	if err != nil {
+		return err
+	}
+	authn, err := newAuthenticator(af.auth, af.keysFile, app)
+	if err != nil {
+		return errors.New("loading api keys:" + err.Error())
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		app.FollowIndex(ctx)
+	}()
+	if *jobs {
+		app.StartJobs(ctx)
+	}
+	err = api.StartApiServer(ctx, app, authn, af.bind, af.port)
+	if err != nil {
+		slog.Error(err.Error())
+	}
+	stop()
+	shutdown(app, authn, &wg)
+	return nil
+}
+
+// runIndex indexes events into the database
+func runIndex(args []string) error {
+	v, _ := loadEnv()
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	bind := fs.String("bind", v.GetString(env.API_BIND_ADDR), "address of the metrics and probe server")
+	port := fs.String("port", "", "port of the metrics and probe server, none if empty")
+	doMigrate := fs.Bool("migrate", true, "run the database migrations on startup")
+	fs.Parse(args)
+	if err := requireEnv(v, env.CONFIG_PATH, env.DATABASE_DSN); err != nil {
+		return err
+	}
+	app, err := newApp(v, *doMigrate)
+	if err != nil {
+		return err
+	}
+	// balances are precomputed by the API processes
+	app.Config.PrecomputeBlocks = -1
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var wg sync.WaitGroup
+	if *port != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := api.StartProbeServer(ctx, app, *bind, *port); err != nil {
+				slog.Error(err.Error())
+				stop()
+			}
+		}()
+	}
+	app.Leader = leader.NewElector(app.Db, app.Config.ChainId)
+	app.RunIndexer(ctx)
+	shutdown(app, nil, &wg)
+	return nil
+}
+
+// runMigrate runs the database migrations
+func runMigrate(args []string) error {
+	v, _ := loadEnv()
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Parse(args)
+	if err := requireEnv(v, env.DATABASE_DSN); err != nil {
+		return err
+	}
+	if err := runMigrations(v.GetString(env.DATABASE_DSN)); err != nil {
+		return errors.New("running migrations:" + err.Error())
+	}
+	slog.Info("migrations run completed")
+	return nil
+}
+
+// newApp creates the app, connects the database and runs the migrations if requested
+func newApp(v *viper.Viper, doMigrate bool) (*etherfi.App, error) {
 	app, err := etherfi.NewApp(v)
 	if err != nil {
-		slog.Error("Error:" + err.Error())
-		return
+		return nil, err
 	}
 	fmt.Println("\nApp:")
 	fmt.Println("proxy address:", app.PerpProxy.Hex())
@@ -41,74 +254,88 @@ func Run() {
 	fmt.Printf("--\n\n")
 	// connect db before running migrations
 	if err := app.ConnectDB(v.GetString(env.DATABASE_DSN)); err != nil {
-		slog.Error("connecting to db", "error", err)
-		return
+		return nil, errors.New("connecting to db:" + err.Error())
 	}
-	// Run migrations on startup. If migrations fail - exit.
-	if err := runMigrations(v.GetString(env.DATABASE_DSN)); err != nil {
-		slog.Error("running migrations", "error", err)
-		os.Exit(1)
-		return
-	} else {
+	if doMigrate {
+		if err := runMigrations(v.GetString(env.DATABASE_DSN)); err != nil {
+			return nil, errors.New("running migrations:" + err.Error())
+		}
 		slog.Info("migrations run completed")
 	}
-	// start go routine to periodically filter for events
-	go app.RunFilter()
+	// continue with the log query windows learned by previous runs
+	if err := app.Filterer.SetWindowStore(app); err != nil {
+		slog.Error("restoring log windows:" + err.Error())
+	}
+	return app, nil
+}
 
-	api.StartApiServer(app, v.GetString(env.API_BIND_ADDR), v.GetString(env.API_PORT))
+// shutdown waits for the event filterer, jobs and background computations to
+// stop within the configured timeout and closes the connections
+func shutdown(app *etherfi.App, authn *auth.Authenticator, wg *sync.WaitGroup) {
+	slog.Info("shutting down")
+	timeout := time.Duration(app.Config.ShutdownTimeoutSec) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Error("event filterer did not stop within the shutdown timeout")
+	}
+	if err := app.Wait(ctx); err != nil {
+		slog.Error("jobs did not stop within the shutdown timeout")
+	}
+	if authn != nil {
+		if err := authn.Close(); err != nil {
+			slog.Error("storing api key usage:" + err.Error())
+		}
+	}
+	app.Close()
+	slog.Info("shutdown completed")
+}
+
+// newAuthenticator creates the API key authenticator, nil if the API is open
+func newAuthenticator(mode, keysFile string, app *etherfi.App) (*auth.Authenticator, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case "db":
+		slog.Info("api keys required, keys stored in database")
+		return auth.NewDbAuthenticator(app.Db, app.Config.RetryAfterSec)
+	case "file":
+		slog.Info("api keys required, keys loaded from " + keysFile)
+		return auth.NewFileAuthenticator(keysFile, app.Config.RetryAfterSec)
+	default:
+		return nil, fmt.Errorf("invalid api key authentication %s, use db or file", mode)
+	}
 }
 
-func loadEnv() (*viper.Viper, error) {
+func loadEnv(requiredEnvs ...string) (*viper.Viper, error) {
 	v := viper.New()
 	v.SetConfigFile(".env")
 	if err := v.ReadInConfig(); err != nil {
 		slog.Info("could not load .env file" + err.Error() + " using automatic envs")
 	}
 	v.AutomaticEnv()
-
-	requiredEnvs := []string{
-		env.CONFIG_PATH,
-		env.DATABASE_DSN,
-		env.API_BIND_ADDR,
-		env.API_PORT,
+	if err := requireEnv(v, requiredEnvs...); err != nil {
+		return nil, err
 	}
+	return v, nil
+}
 
+func requireEnv(v *viper.Viper, requiredEnvs ...string) error {
 	for _, e := range requiredEnvs {
 		if !v.IsSet(e) {
-			return nil, fmt.Errorf("required environment variable not set %s", e)
+			return fmt.Errorf("required environment variable not set %s", e)
 		}
 	}
-
-	return v, nil
+	return nil
 }
 
 func runMigrations(postgresDSN string) error {
-
-	source, err := iofs.New(db.MigrationsFS, "migrations")
-	if err != nil {
-		return err
-	}
-	m, err := migrate.NewWithSourceInstance(
-		"MigrationsFS",
-		source,
-		postgresDSN,
-	)
-	if err != nil {
-		return err
-	}
-	if err := m.Up(); err != nil {
-		// Only return error if it's not "no change" error
-		if err.Error() != "no change" {
-			return err
-		}
-	}
-
-	e1, e2 := m.Close()
-	if e1 != nil {
-		return e1
-	}
-	if e2 != nil {
-		return e2
-	}
-	return nil
+	return db.Migrate(postgresDSN)
 }
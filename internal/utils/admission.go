@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrOverloaded is returned if a computation is not admitted because
+// the maximal number of concurrent computations is reached
+var ErrOverloaded = errors.New("too many concurrent requests")
+
+// Admission limits the number of concurrent computations. Up to maxWaiting
+// callers wait at most maxWait for a free slot, further callers are rejected.
+type Admission struct {
+	slots      chan struct{}
+	maxWaiting int
+	maxWait    time.Duration
+	waiting    int
+	mu         sync.Mutex
+}
+
+func NewAdmission(maxConcurrent, maxWaiting int, maxWait time.Duration) *Admission {
+	return &Admission{
+		slots:      make(chan struct{}, maxConcurrent),
+		maxWaiting: maxWaiting,
+		maxWait:    maxWait,
+	}
+}
+
+// Acquire obtains a slot or returns ErrOverloaded. Release must be
+// called when the computation completes.
+func (a *Admission) Acquire() error {
+	select {
+	case a.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	a.mu.Lock()
+	if a.waiting >= a.maxWaiting {
+		a.mu.Unlock()
+		return ErrOverloaded
+	}
+	a.waiting++
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		a.waiting--
+		a.mu.Unlock()
+	}()
+	timer := time.NewTimer(a.maxWait)
+	defer timer.Stop()
+	select {
+	case a.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return ErrOverloaded
+	}
+}
+
+// Release frees the slot obtained with Acquire
+func (a *Admission) Release() {
+	<-a.slots
+}
+
+// InUse returns the number of running and waiting computations
+func (a *Admission) InUse() (int, int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.slots), a.waiting
+}
@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	a := NewAdmission(1, 1, 50*time.Millisecond)
+	if err := a.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	// one caller may wait, the next one is rejected immediately
+	waitErr := make(chan error)
+	go func() {
+		waitErr <- a.Acquire()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := a.Acquire(); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("expected ErrOverloaded, got %v", err)
+	}
+	// the waiting caller times out
+	if err := <-waitErr; !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("expected ErrOverloaded after waiting, got %v", err)
+	}
+	// released slots are handed to waiting callers
+	go func() {
+		waitErr <- a.Acquire()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	a.Release()
+	if err := <-waitErr; err != nil {
+		t.Fatal(err)
+	}
+	if running, waiting := a.InUse(); running != 1 || waiting != 0 {
+		t.Fatalf("unexpected usage %d %d", running, waiting)
+	}
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Stable, machine-readable error codes of the API
+const (
+	CODE_INVALID_INPUT     = "INVALID_INPUT"
+	CODE_BLOCK_NOT_INDEXED = "BLOCK_NOT_INDEXED"
+	CODE_RPC_UNAVAILABLE   = "RPC_UNAVAILABLE"
+	CODE_UPSTREAM_APR      = "UPSTREAM_APR_UNAVAILABLE"
+	CODE_NOT_FOUND         = "NOT_FOUND"
+	CODE_OVERLOADED        = "OVERLOADED"
+	CODE_QUEUE_FULL        = "QUEUE_FULL"
+	CODE_UNAUTHORIZED      = "UNAUTHORIZED"
+	CODE_RATE_LIMITED      = "RATE_LIMITED"
+	CODE_INTERNAL          = "INTERNAL"
+)
+
+// FieldError is a validation error of a request parameter or body field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// APIError is an error with its HTTP status and the code and details
+// reported to the client
+type APIError struct {
+	Status  int                    `json:"-"`
+	Code    string                 `json:"code"`
+	Message string                 `json:"error"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	Fields  []FieldError           `json:"fields,omitempty"`
+	Err     error                  `json:"-"` // cause, not reported to the client
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// NewInvalidInputError reports invalid request fields (400)
+func NewInvalidInputError(fields ...FieldError) *APIError {
+	return &APIError{
+		Status:  http.StatusBadRequest,
+		Code:    CODE_INVALID_INPUT,
+		Message: "invalid request",
+		Fields:  fields,
+	}
+}
+
+// NewBlockNotIndexedError reports a request for a block beyond the
+// latest indexed block (422)
+func NewBlockNotIndexedError(requested, latest uint64) *APIError {
+	return &APIError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    CODE_BLOCK_NOT_INDEXED,
+		Message: fmt.Sprintf("block %d not indexed yet", requested),
+		Details: map[string]interface{}{"requestedBlock": requested, "latestBlock": latest},
+	}
+}
+
+// NewRpcUnavailableError reports that the blockchain could not be queried (503)
+func NewRpcUnavailableError(err error) *APIError {
+	return &APIError{
+		Status:  http.StatusServiceUnavailable,
+		Code:    CODE_RPC_UNAVAILABLE,
+		Message: "blockchain rpc unavailable",
+		Err:     err,
+	}
+}
+
+// NewUpstreamAprError reports a failure of the etherfi APR endpoint (502)
+func NewUpstreamAprError(err error) *APIError {
+	return &APIError{
+		Status:  http.StatusBadGateway,
+		Code:    CODE_UPSTREAM_APR,
+		Message: "etherfi APR endpoint unavailable",
+		Err:     err,
+	}
+}
+
+// NewNotFoundError reports a missing resource (404)
+func NewNotFoundError(err error) *APIError {
+	return &APIError{
+		Status:  http.StatusNotFound,
+		Code:    CODE_NOT_FOUND,
+		Message: err.Error(),
+		Err:     err,
+	}
+}
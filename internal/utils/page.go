@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+const (
+	SORT_ADDRESS   = "address" // ascending by address
+	SORT_BALANCE   = "balance" // descending by balance, then ascending by address
+	MAX_PAGE_LIMIT = 10_000
+)
+
+// balanceCursor points to the last balance of a page. It contains the
+// block and sort order so that all pages stem from the same snapshot.
+type balanceCursor struct {
+	Block   uint64 `json:"b"`
+	Sort    string `json:"s"`
+	Address string `json:"a"`
+	Amount  string `json:"m"`
+}
+
+// IsPaged returns true if sorting, filtering or pagination is requested
+func (req *APIBalancesPayload) IsPaged() bool {
+	return req.Sort != "" || req.Limit != 0 || req.Cursor != "" || req.MinBalance != 0
+}
+
+// ValidatePage checks the sorting and pagination arguments. If a cursor
+// is given, sort and block number must match the cursor.
+func (req *APIBalancesPayload) ValidatePage() error {
+	switch req.Sort {
+	case "", SORT_ADDRESS, SORT_BALANCE:
+	default:
+		return fmt.Errorf("invalid sort %s, use %s or %s", req.Sort, SORT_ADDRESS, SORT_BALANCE)
+	}
+	if req.Limit < 0 || req.Limit > MAX_PAGE_LIMIT {
+		return fmt.Errorf("limit must be between 0 and %d", MAX_PAGE_LIMIT)
+	}
+	if req.MinBalance < 0 {
+		return errors.New("minBalance must not be negative")
+	}
+	if req.Cursor == "" {
+		return nil
+	}
+	c, err := decodeCursor(req.Cursor)
+	if err != nil {
+		return err
+	}
+	if c.Block != req.BlockNumber {
+		return fmt.Errorf("cursor is for block %d, not %d", c.Block, req.BlockNumber)
+	}
+	if c.Sort != sortOrDefault(req.Sort) {
+		return fmt.Errorf("cursor is for sort %s, not %s", c.Sort, sortOrDefault(req.Sort))
+	}
+	return nil
+}
+
+// CursorBlock returns the block number encoded in the cursor
+func CursorBlock(cursor string) (uint64, error) {
+	c, err := decodeCursor(cursor)
+	if err != nil {
+		return 0, err
+	}
+	return c.Block, nil
+}
+
+// PageBalances filters and sorts the balances and returns the page
+// requested by req together with the cursor of the next page. The cursor
+// is empty if there are no more pages.
+func PageBalances(req APIBalancesPayload, balances []Balance) ([]Balance, string, error) {
+	if err := req.ValidatePage(); err != nil {
+		return nil, "", err
+	}
+	sortBy := sortOrDefault(req.Sort)
+	less := func(a, b *Balance) bool {
+		if sortBy == SORT_BALANCE {
+			if c := amountOf(a).Cmp(amountOf(b)); c != 0 {
+				return c > 0
+			}
+		}
+		return a.Address < b.Address
+	}
+	list := make([]Balance, 0, len(balances))
+	for _, b := range balances {
+		if b.EffBalance >= req.MinBalance {
+			list = append(list, b)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return less(&list[i], &list[j])
+	})
+	start := 0
+	if req.Cursor != "" {
+		c, _ := decodeCursor(req.Cursor)
+		amount, ok := new(big.Int).SetString(c.Amount, 10)
+		if !ok {
+			return nil, "", errors.New("invalid cursor")
+		}
+		last := Balance{Address: c.Address, Amount: amount}
+		start = sort.Search(len(list), func(i int) bool {
+			return less(&last, &list[i])
+		})
+	}
+	end := len(list)
+	if req.Limit > 0 {
+		end = min(end, start+req.Limit)
+	}
+	page := list[start:end]
+	if end == len(list) {
+		return page, "", nil
+	}
+	last := page[len(page)-1]
+	next, err := encodeCursor(balanceCursor{
+		Block:   req.BlockNumber,
+		Sort:    sortBy,
+		Address: last.Address,
+		Amount:  amountOf(&last).String(),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return page, next, nil
+}
+
+func sortOrDefault(s string) string {
+	if s == "" {
+		return SORT_ADDRESS
+	}
+	return s
+}
+
+func amountOf(b *Balance) *big.Int {
+	if b.Amount == nil {
+		return new(big.Int)
+	}
+	return b.Amount
+}
+
+func encodeCursor(c balanceCursor) (string, error) {
+	c.Address = strings.ToLower(c.Address)
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(cursor string) (balanceCursor, error) {
+	var c balanceCursor
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return c, errors.New("invalid cursor")
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, errors.New("invalid cursor")
+	}
+	return c, nil
+}
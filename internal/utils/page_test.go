@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+)
+
+func testBalances(n int) []Balance {
+	balances := make([]Balance, 0, n)
+	for k := 0; k < n; k++ {
+		// balance 10, 11, 12,... for descending addresses; some equal balances
+		amount := big.NewInt(int64(10 + k/2))
+		balances = append(balances, Balance{
+			Address:    fmt.Sprintf("0x%040x", n-k),
+			EffBalance: float64(amount.Int64()),
+			Amount:     amount,
+		})
+	}
+	return balances
+}
+
+func TestPageBalances(t *testing.T) {
+	for _, sortBy := range []string{"", SORT_ADDRESS, SORT_BALANCE} {
+		balances := testBalances(11)
+		req := APIBalancesPayload{BlockNumber: 100, Sort: sortBy, Limit: 3, MinBalance: 11}
+		seen := make([]Balance, 0)
+		for pages := 0; ; pages++ {
+			if pages > 5 {
+				t.Fatalf("sort=%s: too many pages", sortBy)
+			}
+			page, next, err := PageBalances(req, balances)
+			if err != nil {
+				t.Fatalf("sort=%s: %v", sortBy, err)
+			}
+			seen = append(seen, page...)
+			if next == "" {
+				break
+			}
+			req.Cursor = next
+		}
+		// balance 10 is filtered for 2 addresses
+		if len(seen) != 9 {
+			t.Fatalf("sort=%s: expected 9 balances, got %d", sortBy, len(seen))
+		}
+		for k := 1; k < len(seen); k++ {
+			if sortBy == SORT_BALANCE {
+				c := seen[k-1].Amount.Cmp(seen[k].Amount)
+				if c < 0 || (c == 0 && seen[k-1].Address >= seen[k].Address) {
+					t.Fatalf("sort=%s: wrong order at %d", sortBy, k)
+				}
+			} else if seen[k-1].Address >= seen[k].Address {
+				t.Fatalf("sort=%s: wrong order at %d", sortBy, k)
+			}
+		}
+	}
+}
+
+func TestPageBalancesCursorMismatch(t *testing.T) {
+	balances := testBalances(5)
+	req := APIBalancesPayload{BlockNumber: 100, Limit: 2}
+	_, next, err := PageBalances(req, balances)
+	if err != nil || next == "" {
+		t.Fatalf("expected next cursor, got %q %v", next, err)
+	}
+	req.Cursor = next
+	req.BlockNumber = 101
+	if _, _, err := PageBalances(req, balances); err == nil {
+		t.Fatal("expected error for cursor of different block")
+	}
+	req.BlockNumber = 100
+	req.Sort = SORT_BALANCE
+	if _, _, err := PageBalances(req, balances); err == nil {
+		t.Fatal("expected error for cursor of different sort")
+	}
+}
@@ -1,10 +1,15 @@
 package utils
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"log/slog"
 	"sync"
+	"time"
 
+	"github.com/D8-X/d8x-etherfi/internal/metrics"
 	"github.com/ethereum/go-ethereum/ethclient"
 )
 
@@ -12,11 +17,17 @@ type RpcHandler struct {
 	RpcClients []*ethclient.Client
 	lastIdx    int
 	Buckets    map[*ethclient.Client]*TokenBucket
+	endpoints  map[*ethclient.Client]string // metrics label
+	keys       map[*ethclient.Client]string // credential-free key of the url
+	urls       map[*ethclient.Client]string
 	mutex      *sync.Mutex
 }
 
 func (h *RpcHandler) Init(rpcUrls []string, capacity int, refillRate float64) error {
 	h.RpcClients = make([]*ethclient.Client, 0)
+	h.endpoints = make(map[*ethclient.Client]string)
+	h.urls = make(map[*ethclient.Client]string)
+	h.keys = make(map[*ethclient.Client]string)
 	for _, url := range rpcUrls {
 		rpc, err := ethclient.Dial(url)
 		if err != nil {
@@ -24,6 +35,9 @@ func (h *RpcHandler) Init(rpcUrls []string, capacity int, refillRate float64) er
 			continue
 		}
 		h.RpcClients = append(h.RpcClients, rpc)
+		h.endpoints[rpc] = metrics.Endpoint(url)
+		h.urls[rpc] = url
+		h.keys[rpc] = endpointKey(url)
 	}
 	if len(h.RpcClients) == 0 {
 		return errors.New("failed to create rpcs")
@@ -36,8 +50,44 @@ func (h *RpcHandler) Init(rpcUrls []string, capacity int, refillRate float64) er
 	return nil
 }
 
+// WaitForToken blocks until the rate limit of the rpc allows
+// the next call, which is counted in the metrics
 func (h *RpcHandler) WaitForToken(rpc *ethclient.Client) {
+	time0 := time.Now()
 	h.Buckets[rpc].WaitForToken("", false)
+	metrics.TokenWait.WithLabelValues(h.endpoints[rpc]).Observe(time.Since(time0).Seconds())
+	metrics.RpcCalls.WithLabelValues(h.endpoints[rpc]).Inc()
+}
+
+// ReportError counts a failed call of the rpc, retry is true
+// if the call is retried
+func (h *RpcHandler) ReportError(rpc *ethclient.Client, retry bool) {
+	metrics.RpcErrors.WithLabelValues(h.endpoints[rpc]).Inc()
+	if retry {
+		metrics.RpcRetries.WithLabelValues(h.endpoints[rpc]).Inc()
+	}
+}
+
+// Url returns the url of the rpc
+func (h *RpcHandler) Url(rpc *ethclient.Client) string {
+	return h.urls[rpc]
+}
+
+// Endpoint returns the host of the rpc url, which does not contain credentials
+func (h *RpcHandler) Endpoint(rpc *ethclient.Client) string {
+	return h.endpoints[rpc]
+}
+
+// Key identifies the rpc url without containing credentials, urls of the
+// same host with different paths or API keys have different keys
+func (h *RpcHandler) Key(rpc *ethclient.Client) string {
+	return h.keys[rpc]
+}
+
+// endpointKey is the host of the url followed by a hash of the full url
+func endpointKey(rpcUrl string) string {
+	hash := sha256.Sum256([]byte(rpcUrl))
+	return metrics.Endpoint(rpcUrl) + "/" + hex.EncodeToString(hash[:8])
 }
 
 func (h *RpcHandler) GetRpc() *ethclient.Client {
@@ -50,3 +100,37 @@ func (h *RpcHandler) GetNextRpc() *ethclient.Client {
 	h.lastIdx = (h.lastIdx + 1) % len(h.RpcClients)
 	return h.RpcClients[h.lastIdx]
 }
+
+// HeadBlock returns the latest block reported by the rpcs. Rpcs that do not
+// answer within timeout are ignored, an error is returned if none answers.
+func (h *RpcHandler) HeadBlock(timeout time.Duration) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	heads := make(chan uint64, len(h.RpcClients))
+	for _, rpc := range h.RpcClients {
+		go func(rpc *ethclient.Client) {
+			block, err := rpc.BlockNumber(ctx)
+			if err != nil {
+				h.ReportError(rpc, false)
+				heads <- 0
+				return
+			}
+			heads <- block
+		}(rpc)
+	}
+	var head uint64
+	for range h.RpcClients {
+		head = max(head, <-heads)
+	}
+	if head == 0 {
+		return 0, errors.New("no rpc answering")
+	}
+	return head, nil
+}
+
+// Close closes the connections to all rpcs
+func (h *RpcHandler) Close() {
+	for _, rpc := range h.RpcClients {
+		rpc.Close()
+	}
+}
@@ -0,0 +1,20 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEndpointKey(t *testing.T) {
+	k1 := endpointKey("https://arb-mainnet.g.alchemy.com/v2/key1")
+	k2 := endpointKey("https://arb-mainnet.g.alchemy.com/v2/key2")
+	if k1 == k2 {
+		t.Fatalf("urls of the same host share the key %s", k1)
+	}
+	if !strings.HasPrefix(k1, "arb-mainnet.g.alchemy.com/") || strings.Contains(k1, "key1") {
+		t.Fatalf("unexpected key %s", k1)
+	}
+	if endpointKey("https://arb-mainnet.g.alchemy.com/v2/key1") != k1 {
+		t.Fatal("key not stable")
+	}
+}
@@ -2,9 +2,12 @@ package utils
 
 import (
 	"encoding/json"
+	"fmt"
 	"log/slog"
+	"math/big"
 	"os"
 	"regexp"
+	"time"
 
 	config "github.com/D8-X/d8x-futures-go-sdk/config"
 	"github.com/ethereum/go-ethereum/common"
@@ -13,15 +16,62 @@ import (
 type APIBalancesPayload struct {
 	BlockNumber uint64   `json:"blockNumber"`
 	Addresses   []string `json:"addresses"`
+	Sort        string   `json:"sort,omitempty"`       // "address" or "balance"
+	Limit       int      `json:"limit,omitempty"`      // page size, 0 for all
+	Cursor      string   `json:"cursor,omitempty"`     // nextCursor of the previous page
+	MinBalance  float64  `json:"minBalance,omitempty"` // only report balances >= minBalance
 }
 
 type APIBalancesResponse struct {
-	Result []Balance `json:"Result"`
+	Result      []Balance    `json:"Result"`
+	NextCursor  string       `json:"nextCursor,omitempty"`
+	Precomputed *Precomputed `json:"precomputed,omitempty"`
+	Attestation *Attestation `json:"attestation,omitempty"`
+}
+
+// Precomputed is set if the balances stem from the continuously
+// precomputed latest balances
+type Precomputed struct {
+	BlockNumber uint64  `json:"blockNumber"`
+	ComputedAt  int64   `json:"computedAt"` // unix timestamp
+	AgeSec      float64 `json:"ageSeconds"`
+}
+
+// Attestation is an EIP-712 signature over the balances of a response.
+// Amounts are the effective balances in decimal-N units, ordered like
+// the balances in the response.
+type Attestation struct {
+	ChainId     int64    `json:"chainId"`
+	BlockNumber uint64   `json:"blockNumber"`
+	PoolToken   string   `json:"poolToken"`
+	Amounts     []string `json:"amounts"`
+	Signer      string   `json:"signer"`
+	Signature   string   `json:"signature"`
 }
 
 type Balance struct {
-	Address    string  `json:"address"`
-	EffBalance float64 `json:"effective_balance"`
+	Address    string   `json:"address"`
+	EffBalance float64  `json:"effective_balance"`
+	Amount     *big.Int `json:"-"` // effective balance in decimal-N units of the pool token
+}
+
+type APISnapshotPayload struct {
+	BlockNumber uint64 `json:"blockNumber"`
+}
+
+type APISnapshotResponse struct {
+	BlockNumber uint64 `json:"blockNumber"`
+	MerkleRoot  string `json:"merkleRoot"`
+	NumLeaves   int    `json:"numLeaves"`
+}
+
+type APIProofResponse struct {
+	BlockNumber uint64   `json:"blockNumber"`
+	MerkleRoot  string   `json:"merkleRoot"`
+	Address     string   `json:"address"`
+	Amount      string   `json:"amount"`
+	Leaf        string   `json:"leaf"`
+	Proof       []string `json:"proof"`
 }
 
 type FSResultSet struct {
@@ -46,12 +96,130 @@ type Config struct {
 	PerpAddr common.Address `json:"perpAddr"`
 }
 
+// BuildVersion is set at build time with
+// -ldflags "-X github.com/D8-X/d8x-etherfi/internal/utils.BuildVersion=<version>"
+var BuildVersion = "dev"
+
+// APIStatusResponse describes the service and up to which block its data is valid
+type APIStatusResponse struct {
+	ChainId           int64             `json:"chainId"`
+	PoolId            int32             `json:"poolId"`
+	PoolTokenAddr     string            `json:"poolTokenAddr"`
+	PoolTokenDecimals uint8             `json:"poolTokenDecimals"`
+	ShareTokenAddr    string            `json:"shareTokenAddr"`
+	GenesisBlock      uint64            `json:"genesisBlock"`
+	IndexedBlocks     map[string]uint64 `json:"indexedBlocks"` // per event type
+	IndexedBlock      uint64            `json:"indexedBlock"`  // data is valid up to this block
+	ChainHead         uint64            `json:"chainHead"`
+	Lag               uint64            `json:"lag"`
+	LastFilterRun     *FilterRun        `json:"lastFilterRun,omitempty"`
+	Leader            bool              `json:"leader"` // this instance runs the indexer
+	RangeChecks       []RangeCheck      `json:"rangeChecks,omitempty"`
+	Version           string            `json:"version"`
+}
+
+// FilterRun is the result of an event filter cycle
+type FilterRun struct {
+	StartedOn  time.Time         `json:"startedOn"`
+	FinishedOn time.Time         `json:"finishedOn"`
+	Events     map[string]int    `json:"events"`           // number of events found per event type
+	Errors     map[string]string `json:"errors,omitempty"` // errors per event type
+	Ok         bool              `json:"ok"`
+}
+
+// BlockRange is the block range [From, To]
+type BlockRange struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+// RangeCheck reports the gaps and overlaps of the indexed block ranges of an event type
+type RangeCheck struct {
+	Event     string       `json:"event"`
+	CheckedOn time.Time    `json:"checkedOn"`
+	From      uint64       `json:"from"`
+	To        uint64       `json:"to"`
+	Gaps      []BlockRange `json:"gaps"`     // blocks not indexed
+	Overlaps  []BlockRange `json:"overlaps"` // blocks indexed more than once
+}
+
+// APIHistoryResponse lists the perpetual events of a trader in block order
+type APIHistoryResponse struct {
+	Address      string       `json:"address"`
+	IndexedBlock uint64       `json:"indexedBlock"` // the events are indexed up to this block
+	Gaps         []BlockRange `json:"gaps"`         // blocks of the requested range whose events are not indexed yet
+	Events       []PerpEvent  `json:"events"`
+	NextCursor   string       `json:"nextCursor,omitempty"`
+}
+
+// PerpEvent is a trade, deposit, withdrawal, liquidation or settlement of a trader in
+// a perpetual. Amounts in base currency (BC) for trades and liquidations, in collateral
+// currency (CC) otherwise.
+type PerpEvent struct {
+	Event         string   `json:"event"`
+	PerpetualId   int32    `json:"perpetualId"`
+	BlockNumber   uint64   `json:"blockNumber"`
+	TxHash        string   `json:"txHash"`
+	LogIndex      int      `json:"logIndex"`
+	Amount        float64  `json:"amount"`
+	Price         *float64 `json:"price,omitempty"`         // trades and liquidations
+	NewPositionBC *float64 `json:"newPositionBC,omitempty"` // position size after trades and liquidations
+	FeeCC         *float64 `json:"feeCC,omitempty"`         // trades and liquidations
+	PnlCC         *float64 `json:"pnlCC,omitempty"`         // trades and liquidations
+	Liquidator    string   `json:"liquidator,omitempty"`
+	OrderDigest   string   `json:"orderDigest,omitempty"`
+}
+
+// APIReadyResponse reports the readiness of the service
+type APIReadyResponse struct {
+	Ready        bool   `json:"ready"`
+	IndexedBlock uint64 `json:"indexedBlock"`
+	ChainHead    uint64 `json:"chainHead"`
+	Lag          uint64 `json:"lag"`
+	MaxLag       uint64 `json:"maxLag"`
+	Error        string `json:"error,omitempty"`
+}
+
 type ConfigFile struct {
-	ChainId     int64    `json:"chainId"`
-	PoolId      int32    `json:"poolId"`
-	Genesis     uint64   `json:"genesisBlock"`
-	RpcUrls     []string `json:"rpcUrl"`
-	RpcUrlsFltr []string `json:"rpcUrlFilterer"`
+	ChainId            int64                   `json:"chainId"`
+	PoolId             int32                   `json:"poolId"`
+	Genesis            uint64                  `json:"genesisBlock"`
+	RpcUrls            []string                `json:"rpcUrl"`
+	RpcUrlsFltr        []string                `json:"rpcUrlFilterer"`
+	RpcUrlWs           string                  `json:"rpcUrlWs"`               // optional websocket rpc to stream events
+	JobWorkers         int                     `json:"jobWorkers"`             // number of workers for asynchronous balance jobs
+	JobMaxQueued       int                     `json:"jobMaxQueued"`           // maximal number of queued balance jobs
+	JobRetentionMins   int                     `json:"jobRetentionMinutes"`    // completed jobs are removed after this period
+	CacheMaxEntries    int                     `json:"cacheMaxEntries"`        // maximal number of cached balance results, -1 to disable
+	CacheTtlSec        int                     `json:"cacheTtlSeconds"`        // cached balance results expire after this period
+	CacheFinality      uint64                  `json:"cacheFinalityBlocks"`    // only results this many blocks below the indexed block are cached
+	PrecomputeBlocks   int                     `json:"precomputeBlocks"`       // minimal number of blocks between precomputations of the latest balances, -1 to disable
+	MaxBalanceCalcs    int                     `json:"maxBalanceCalcs"`        // maximal number of concurrent balance computations
+	MaxBalanceQueue    int                     `json:"maxBalanceQueue"`        // maximal number of balance requests waiting for a computation slot
+	BalanceQueueSec    int                     `json:"balanceQueueSeconds"`    // maximal waiting time for a computation slot
+	RetryAfterSec      int                     `json:"retryAfterSeconds"`      // Retry-After for rejected requests
+	RpcBudget          RpcBudget               `json:"rpcBudget"`              // RPC rate limit for API requests, per RPC
+	RpcBudgetFltr      RpcBudget               `json:"rpcBudgetFilterer"`      // RPC rate limit for the event filterer, per RPC
+	MaxLagBlocks       uint64                  `json:"maxLagBlocks"`           // the service is not ready if the indexer lags more blocks behind the chain head
+	ValidateResponses  bool                    `json:"validateResponses"`      // log responses that violate the OpenAPI specification
+	ShutdownTimeoutSec int                     `json:"shutdownTimeoutSeconds"` // maximal time to complete requests and indexing on shutdown
+	RpcLogWindows      map[string]RpcLogWindow `json:"rpcLogWindows"`          // log query window limits per filterer rpc url
+	FilterWorkers      int                     `json:"filterWorkers"`          // number of concurrent workers filtering historical blocks, default one per filterer RPC
+	RepairBlocks       int                     `json:"repairBlocks"`           // maximal number of blocks the indexer re-indexes per cycle to repair gaps and overlaps, -1 to disable
+}
+
+// RpcLogWindow limits the number of blocks per log query of an RPC,
+// zero values are replaced by the defaults of the filterer
+type RpcLogWindow struct {
+	Initial uint64 `json:"initial"`
+	Min     uint64 `json:"min"`
+	Max     uint64 `json:"max"`
+}
+
+// RpcBudget is the token bucket configuration of an RPC
+type RpcBudget struct {
+	Capacity   int     `json:"capacity"`
+	RefillRate float64 `json:"refillRate"` // tokens per second
 }
 
 func LoadConfig(filePath string) (Config, error) {
@@ -65,6 +233,10 @@ func LoadConfig(filePath string) (Config, error) {
 	if err != nil {
 		return Config{}, err
 	}
+	conf.setDefaults()
+	if err := conf.validate(); err != nil {
+		return Config{}, err
+	}
 	// Assign ConfigFile to Config and fill remaining values
 	c, err := config.GetDefaultChainConfigFromId(int64(conf.ChainId))
 	if err != nil {
@@ -78,6 +250,80 @@ func LoadConfig(filePath string) (Config, error) {
 	return config, nil
 }
 
+// setDefaults sets the default values of optional settings
+func (conf *ConfigFile) setDefaults() {
+	if conf.JobWorkers == 0 {
+		conf.JobWorkers = 2
+	}
+	if conf.JobMaxQueued == 0 {
+		conf.JobMaxQueued = 100
+	}
+	if conf.JobRetentionMins == 0 {
+		conf.JobRetentionMins = 24 * 60
+	}
+	if conf.CacheMaxEntries == 0 {
+		conf.CacheMaxEntries = 64
+	}
+	if conf.CacheTtlSec == 0 {
+		conf.CacheTtlSec = 3600
+	}
+	if conf.CacheFinality == 0 {
+		conf.CacheFinality = 64
+	}
+	if conf.MaxBalanceCalcs == 0 {
+		conf.MaxBalanceCalcs = 4
+	}
+	if conf.MaxBalanceQueue == 0 {
+		conf.MaxBalanceQueue = 16
+	}
+	if conf.BalanceQueueSec == 0 {
+		conf.BalanceQueueSec = 30
+	}
+	if conf.RetryAfterSec == 0 {
+		conf.RetryAfterSec = 10
+	}
+	if conf.ShutdownTimeoutSec == 0 {
+		conf.ShutdownTimeoutSec = 30
+	}
+	if conf.FilterWorkers == 0 {
+		conf.FilterWorkers = max(1, len(conf.RpcUrlsFltr))
+	}
+	if conf.RepairBlocks == 0 {
+		conf.RepairBlocks = 100_000
+	}
+	if conf.MaxLagBlocks == 0 {
+		conf.MaxLagBlocks = 2000
+	}
+	for _, b := range []*RpcBudget{&conf.RpcBudget, &conf.RpcBudgetFltr} {
+		if b.Capacity == 0 {
+			b.Capacity = 5
+		}
+		if b.RefillRate == 0 {
+			b.RefillRate = 5
+		}
+	}
+}
+
+// validate rejects settings that cannot be used, after the defaults are set
+func (conf *ConfigFile) validate() error {
+	for _, setting := range []struct {
+		name  string
+		value int
+	}{
+		{"maxBalanceCalcs", conf.MaxBalanceCalcs},
+		{"maxBalanceQueue", conf.MaxBalanceQueue},
+		{"balanceQueueSeconds", conf.BalanceQueueSec},
+		{"jobWorkers", conf.JobWorkers},
+		{"jobMaxQueued", conf.JobMaxQueued},
+		{"jobRetentionMinutes", conf.JobRetentionMins},
+	} {
+		if setting.value < 0 {
+			return fmt.Errorf("invalid config: %s must not be negative, got %d", setting.name, setting.value)
+		}
+	}
+	return nil
+}
+
 func IsValidEvmAddr(addr string) bool {
 	// Define a regular expression pattern for Ethereum addresses
 	// It should start with "0x" followed by 40 hexadecimal characters
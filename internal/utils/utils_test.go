@@ -0,0 +1,22 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigNegativeLimits(t *testing.T) {
+	for _, setting := range []string{"maxBalanceCalcs", "maxBalanceQueue"} {
+		file := filepath.Join(t.TempDir(), "config.json")
+		data := `{"chainId": 42161, "poolId": 2, "` + setting + `": -1}`
+		if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadConfig(file)
+		if err == nil || !strings.Contains(err.Error(), setting) {
+			t.Fatalf("expected config error for %s, got %v", setting, err)
+		}
+	}
+}